@@ -0,0 +1,226 @@
+// admin - Snapshot and Restore of the live database.
+// /admin/snapshot takes a consistent copy of every Page in the Data.db
+// format, as a download or into -snapshot-dir. /admin/restore checks an
+// uploaded copy in full and then swaps it in through Storage.Restore, so
+// requests see either the old database or the restored one.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var snapshotDir = flag.String("snapshot-dir", "", "Directory /admin/snapshot?save=1 writes snapshots to")
+
+const maxRestoreBytes = 256 << 20 // Largest snapshot /admin/restore accepts
+
+//
+// Take a Snapshot -- Every Page as of one moment, encoded like Data.db
+//
+// List copies the Pages under the read lock, so writers wait only for the
+// copy; the encoding happens after.
+//
+func takeSnapshot(s Storage, encoding string) ([]byte, int, error) {
+	pages := s.List()
+	data, err := encodeSnapshot(pages, encoding)
+	return data, len(pages), err
+}
+
+//
+// Snapshot file name for time t -- Data-20060102T150405Z.db
+//
+func snapshotName(t time.Time) string {
+	return "Data-" + t.Format("20060102T150405Z") + ".db"
+}
+
+//
+// Save a Snapshot into dir -- Written beside it, flushed, then renamed into place
+//
+func saveSnapshot(dir string, data []byte, t time.Time) (string, error) {
+	file := filepath.Join(dir, snapshotName(t))
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return file, syncDir(dir)
+}
+
+//
+// Pages of an uploaded Snapshot -- Checked in full before anything changes
+//
+// Any format version or encoding Data.db accepts is accepted; every checksum
+// must match and Names and IDs must be unique. Pages without an ID get one,
+// and every Page gets a Version above any in use, so no ETag or edit form
+// from before the restore matches it.
+//
+func restorePages(data []byte, current []Page) ([]Page, error) {
+	pages, _, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]int{} // Name ==> Page it was first seen in
+	ids := map[string]int{}   // ID ==> Page it was first seen in
+	for i, p := range pages {
+		if len(p.Name) <= 0 {
+			return nil, fmt.Errorf("page %d: %v", i, errBlankName)
+		}
+		if first, ok := names[p.Name]; ok {
+			return nil, fmt.Errorf("page %d: name %q repeats page %d", i, p.Name, first)
+		}
+		if first, ok := ids[p.ID]; ok && len(p.ID) > 0 {
+			return nil, fmt.Errorf("page %d: ID %s repeats page %d", i, p.ID, first)
+		}
+		names[p.Name] = i
+		ids[p.ID] = i
+	}
+	top := 0
+	for _, p := range current {
+		if p.Version > top {
+			top = p.Version
+		}
+	}
+	for i := range pages {
+		if len(pages[i].ID) <= 0 {
+			pages[i].ID = newID()
+		}
+		pages[i].Index = i
+		pages[i].Version = top + 1
+	}
+	return pages, nil
+}
+
+//
+// Snapshot Handler --
+//
+// localhost:8080/admin/snapshot         -- Downloads a copy of the database
+// localhost:8080/admin/snapshot?save=1  -- Writes it into -snapshot-dir instead
+//
+// ?encoding=binary picks the binary Data.db encoding (default -encoding).
+//
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	encoding := r.FormValue("encoding")
+	if len(encoding) <= 0 {
+		encoding = *dataEncoding
+	}
+	if encoding != "json" && encoding != "binary" {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("unknown encoding %q", encoding))
+		return
+	}
+	save := len(r.FormValue("save")) > 0
+	if save && len(*snapshotDir) <= 0 {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("no -snapshot-dir configured"))
+		return
+	}
+	t := now()
+	data, n, err := takeSnapshot(db, encoding)
+	check("Snapshot Failed", err)
+	if !save {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+snapshotName(t)+"\"")
+		w.Write(data)
+		return
+	}
+	file, err := saveSnapshot(*snapshotDir, data, t)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Saved string
+		Pages int
+		Bytes int
+	}{file, n, len(data)})
+}
+
+//
+// Restore Handler --
+//
+// POST localhost:8080/admin/restore  -- Replaces the database with the posted snapshot
+//
+//	curl --data-binary @Data-20240501T120000Z.db localhost:8080/admin/restore
+//
+// A snapshot that does not decode or check out is refused with 400 Bad
+// Request and nothing changes.
+//
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("POST a snapshot"))
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRestoreBytes))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	pages, err := restorePages(data, listPages(db))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid snapshot: %v", err))
+		return
+	}
+	err = db.Restore(pages)
+	check("Restore Failed", err)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"Restored": len(pages)})
+}
+
+//
+// Stats Handler --
+//
+// localhost:8080/admin/stats  -- Space saved by compression, cache use
+//
+//	Written  -- Bodies written since startup, as stored and plain
+//	DataFile -- Bodies in Data.db now (-storage file)
+//	Cache    -- The Body cache (-storage disk)
+//
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]interface{}{"Written": writtenStats().report()}
+	if *storageKind == "file" {
+		data, err := ioutil.ReadFile(dataFile)
+		if err == nil {
+			var st compressionStats
+			if st, err = fileCompression(data); err == nil {
+				stats["DataFile"] = st.report()
+			}
+		}
+		if err != nil {
+			stats["DataFile"] = err.Error()
+		}
+	}
+	if d, ok := db.(*diskStorage); ok {
+		size, entries, hits, misses := d.cache.stats()
+		stats["Cache"] = map[string]int64{"Bytes": size, "Limit": d.cache.limit, "Entries": int64(entries), "Hits": hits, "Misses": misses}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+//
+// Admin error -- JSON, like /batch/
+//
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"Error": err.Error()})
+}
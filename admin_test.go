@@ -0,0 +1,129 @@
+// admin_test - Test Suite for the db_demo Snapshot and Restore.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// Test Snapshot and Restore -- Every backend gets back exactly the snapshot
+//
+func TestSnapshotRestore(t *testing.T) {
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+	for _, kind := range []string{"file", "disk", "dir", "memory"} {
+		removeDatabase()
+		*storageKind = kind
+		loadDatabase()
+
+		snap := testRequest(snapshotHandler, "GET", "/admin/snapshot", "")
+		if cd := snap.Header().Get("Content-Disposition"); !strings.Contains(cd, "attachment; filename=\"Data-") {
+			t.Errorf("%s: Content-Disposition %q", kind, cd)
+		}
+		want := namesAndBodies(db.List())
+		ann, _ := db.Get("Ann")
+
+		testCheck(db.Put(Page{Name: "Ann", Body: []byte("Changed")}))
+		testCheck(db.Put(Page{Name: "Henry", Body: []byte("Henry Data")}))
+		testCheck(db.Delete("Charles"))
+
+		w := testRequest(restoreHandler, "POST", "/admin/restore", snap.Body.String())
+		if w.Code != 200 || w.Body.String() != "{\"Restored\":5}\n" {
+			t.Errorf("%s: restore = %d %q", kind, w.Code, w.Body.String())
+		}
+		if got := namesAndBodies(db.List()); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: restored\n\tExpected:\t%q\n\tGot:\t%q", kind, want, got)
+		}
+		if p, _ := db.Get("Ann"); p.ID != ann.ID || p.Version <= 2 {
+			t.Errorf("%s: restored Ann has ID %s, Version %d", kind, p.ID, p.Version)
+		}
+		if kind != "memory" {
+			before := db.List()
+			loadDatabase() // The restore is on disk
+			if !reflect.DeepEqual(db.List(), before) {
+				t.Errorf("%s: reloaded\n\tExpected:\t%v\n\tGot:\t%v", kind, before, db.List())
+			}
+		}
+	}
+	removeDatabase()
+}
+
+//
+// Body as it appears in a JSON snapshot
+//
+func b64(body string) string {
+	return base64.StdEncoding.EncodeToString([]byte(body))
+}
+
+//
+// Test bad restores -- Refused, and the database is left alone
+//
+func TestRestoreInvalid(t *testing.T) {
+	testDatabase([]byte(cajmj_db))
+	good, err := encodeSnapshot(db.List(), "json")
+	testCheck(err)
+	want := namesAndBodies(db.List())
+
+	pages := db.List()
+	pages[1].Name = pages[0].Name
+	duplicate, err := encodeSnapshot(pages, "json")
+	testCheck(err)
+
+	cases := []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{"garbage", "POST", "not a snapshot", 400},
+		{"truncated", "POST", string(good[:len(good)/2]), 400},
+		{"bad checksum", "POST", strings.Replace(string(good), b64("Ann Data"), b64("Ann Dat4"), 1), 400},
+		{"duplicate name", "POST", string(duplicate), 400},
+		{"GET", "GET", string(good), 405},
+	}
+	for _, c := range cases {
+		w := testRequest(restoreHandler, c.method, "/admin/restore", c.body)
+		if w.Code != c.status {
+			t.Errorf("%s: status %d %q, Expected %d", c.name, w.Code, w.Body.String(), c.status)
+		}
+		if got := namesAndBodies(db.List()); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: database changed to %q", c.name, got)
+		}
+	}
+}
+
+//
+// Test saved snapshots -- Written into -snapshot-dir, readable like Data.db
+//
+func TestSnapshotSave(t *testing.T) {
+	defer func(dir string) { *snapshotDir = dir }(*snapshotDir)
+	testDatabase([]byte(cajmj_db))
+
+	*snapshotDir = ""
+	if w := testRequest(snapshotHandler, "GET", "/admin/snapshot?save=1", ""); w.Code != 400 {
+		t.Errorf("save without -snapshot-dir: %d %q", w.Code, w.Body.String())
+	}
+
+	*snapshotDir = t.TempDir()
+	w := testRequest(snapshotHandler, "GET", "/admin/snapshot?save=1&encoding=binary", "")
+	var res struct {
+		Saved string
+		Pages int
+	}
+	testCheck(json.Unmarshal(w.Body.Bytes(), &res))
+	data, err := ioutil.ReadFile(res.Saved)
+	testCheck(err)
+	if !bytes.HasPrefix(data, []byte(binaryMagic)) || res.Pages != 5 {
+		t.Errorf("saved %s: %d pages, %d bytes", res.Saved, res.Pages, len(data))
+	}
+	pages, _, err := decodeSnapshot(data)
+	testCheck(err)
+	if !reflect.DeepEqual(pages, db.List()) {
+		t.Error("\nSaved    = ", pages, "\nExpected = ", db.List())
+	}
+}
@@ -0,0 +1,303 @@
+// batch - Atomic Multi-Page Changes.
+// A Batch is a list of put, delete and rename Operations. The whole Batch
+// is checked against the database first; if any Operation would fail,
+// nothing is changed. Otherwise it is applied under one lock, and the
+// File Storage writes it as a single Log record.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type Op struct { // One Operation of a Batch
+	Op      string    // "put", "delete", "rename", "purge", "trash" or "restore"
+	Page    Page      `json:",omitzero"`  // put: The Page, as for Storage.Put
+	Name    string    `json:",omitempty"` // Every other Operation: The Page to change
+	NewName string    `json:",omitempty"` // rename: Its new Name
+	Version int       `json:",omitempty"` // Every other Operation: Version the Page must still have -- Zero for any
+	Kept    int       `json:",omitempty"` // put, as logged: Page.History leaves out this many stored revisions (see history.go)
+	Deleted time.Time `json:",omitzero"`  // trash: When the Page was deleted (see trash.go)
+}
+
+type batchError struct { // Refused Batch -- Nothing was applied
+	Index int   // Operation that failed
+	Op    Op    // The Operation itself
+	Err   error // Why it failed
+}
+
+func (e *batchError) Error() string {
+	name := e.Op.Name
+	if e.Op.Op == "put" {
+		name = e.Op.Page.Name
+	}
+	return fmt.Sprintf("operation %d (%s %q): %v", e.Index, e.Op.Op, name, e.Err)
+}
+
+//
+// Check a Batch without changing anything (s.mu held) -- Returns the Operations with their IDs
+//
+// Each Operation is checked against the database as the ones before it
+// leave it, so a Batch can rename a Page and then put one under the old Name.
+//
+// A delete or rename only sees Pages live at t, as findName does: an
+// expired or trashed Page is not found, and a rename onto its Name purges
+// it first (the purge is added to the Operations returned). A purge sees
+// every Page -- The Sweeper and the Trash use it. A trash sees the Pages
+// live at t and a restore the Pages in the trash at t; both change only
+// Deleted and the Version, so no Body is carried. Zero t sees every Page,
+// for Operations that were checked when they were logged.
+//
+func (s *memStorage) checkBatch(ops []Op, t time.Time) ([]Op, error) {
+	changed := map[string]*Page{} // Name ==> Page after the Operations so far, nil once gone
+	newIDs := map[string]bool{}   // IDs given to new Pages by this Batch
+	lookup := func(name string) (Page, bool) {
+		if p, ok := changed[name]; ok {
+			if p == nil {
+				return Page{}, false
+			}
+			return *p, true
+		}
+		i, ok := s.byName[name]
+		if !ok {
+			return Page{}, false
+		}
+		return s.pages[i], true
+	}
+	visible := func(name string) (Page, bool) {
+		p, ok := lookup(name)
+		return p, ok && (t.IsZero() || live(p, t))
+	}
+
+	checked := make([]Op, 0, len(ops))
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "put":
+			p := op.Page
+			old, ok := lookup(p.Name)
+			switch {
+			case len(p.Name) <= 0:
+				err = errBlankName
+			case p.Version == versionNew && ok, p.Version > 0 && (!ok || old.Version != p.Version):
+				err = errConflict
+			case ok:
+				p.ID = old.ID // IDs never change
+				p.Version = old.Version + 1
+			case len(p.ID) <= 0:
+				p.ID = newID()
+			default:
+				if _, taken := s.byID[p.ID]; taken || newIDs[p.ID] {
+					err = errDuplicateID
+				}
+			}
+			if !ok {
+				p.Version = 1
+				newIDs[p.ID] = true
+			}
+			changed[p.Name] = &p
+			op.Page.ID = p.ID // The Log replays to the same IDs
+		case "delete", "purge":
+			find := visible
+			if op.Op == "purge" {
+				find = lookup
+			}
+			if p, ok := find(op.Name); !ok {
+				err = errNotFound
+			} else if op.Version != 0 && p.Version != op.Version {
+				err = errConflict
+			}
+			changed[op.Name] = nil
+		case "rename":
+			p, ok := visible(op.Name)
+			_, taken := visible(op.NewName)
+			if _, hidden := lookup(op.NewName); hidden && !taken && ok {
+				checked = append(checked, Op{Op: "purge", Name: op.NewName}) // Expired or trashed -- Gone for good
+			}
+			switch {
+			case !ok:
+				err = errNotFound
+			case op.Version != 0 && p.Version != op.Version:
+				err = errConflict
+			case len(op.NewName) <= 0:
+				err = errBlankName
+			case taken:
+				err = errNameTaken
+			}
+			p.Name = op.NewName
+			p.Version++
+			changed[op.Name] = nil
+			changed[op.NewName] = &p
+		case "trash", "restore":
+			p, ok := lookup(op.Name)
+			if op.Op == "trash" {
+				ok = ok && (t.IsZero() || live(p, t))
+			} else {
+				ok = ok && (t.IsZero() || inTrash(p, t))
+				op.Deleted = time.Time{} // Out of the trash
+			}
+			switch {
+			case !ok:
+				err = errNotFound
+			case op.Version != 0 && p.Version != op.Version:
+				err = errConflict
+			case op.Op == "trash" && op.Deleted.IsZero():
+				err = fmt.Errorf("trash without a Deleted time")
+			}
+			p.Deleted = op.Deleted
+			p.Version++
+			changed[op.Name] = &p
+		default:
+			err = fmt.Errorf("unknown operation %q", op.Op)
+		}
+		if err != nil {
+			return nil, &batchError{Index: i, Op: ops[i], Err: err}
+		}
+		checked = append(checked, op)
+	}
+	return checked, nil
+}
+
+//
+// Error of a single Operation -- As the Storage returns it for Put and Delete
+//
+func opError(err error) error {
+	if be, ok := err.(*batchError); ok {
+		return be.Err
+	}
+	return err
+}
+
+//
+// Apply a checked Batch (s.mu held) -- Cannot fail once checkBatch passed
+//
+func (s *memStorage) applyBatch(ops []Op) error {
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "put":
+			err = s.put(op.Page)
+		case "delete", "purge":
+			err = s.remove(op.Name)
+		case "rename":
+			err = s.rename(op.Name, op.NewName)
+		case "trash", "restore":
+			err = s.setDeleted(op.Name, op.Deleted)
+		}
+		if err != nil {
+			return &batchError{Index: i, Op: op, Err: err}
+		}
+	}
+	return nil
+}
+
+type batchRequest struct { // One Operation as posted to /batch/
+	Op      string // "put", "delete" or "rename"
+	Name    string // Page to change
+	NewName string // rename: Its new Name
+	Body    string // put: The new Body
+	Version int    // put: Version it was read at (see etag.go) -- Zero for any
+	Expires string // put: Expiry as for /save/ (see expiry.go) -- Blank keeps it, "never" clears it
+}
+
+//
+// Batch Operations for a request -- A put saves a revision, like /save/
+//
+// A put without an Expires keeps the expiry the Page has, as /save/ does
+// when the field is not sent.
+//
+func batchOps(reqs []batchRequest) ([]Op, error) {
+	ops := make([]Op, len(reqs))
+	touched := map[string]bool{} // Names an earlier Operation changes -- Not as stored
+	for i, req := range reqs {
+		ops[i] = Op{Op: req.Op, Name: req.Name, NewName: req.NewName}
+		switch req.Op {
+		case "purge", "trash", "restore": // Only for the Sweeper and the Trash
+			return nil, &batchError{Index: i, Op: ops[i], Err: fmt.Errorf("unknown operation %q", req.Op)}
+		}
+		if req.Op == "put" {
+			body := []byte(req.Body)
+			np := Page{Name: req.Name, Body: body, Rev: 1, Saved: now(), Version: req.Version}
+			expires, err := parseExpires(req.Expires, np.Saved)
+			if err != nil {
+				return nil, &batchError{Index: i, Op: ops[i], Err: err}
+			}
+			if old, ok := db.Get(req.Name); ok && !expired(old, np.Saved) && !touched[req.Name] {
+				np, _ = nextRevision(old, body)
+				np.Version = old.Version // Any change since Get is a conflict
+				if req.Version != 0 {
+					np.Version = req.Version
+				}
+				if len(req.Expires) <= 0 {
+					expires = old.Expires // Not sent -- Keep the expiry
+				}
+			}
+			np.Expires = expires
+			np.Deleted = time.Time{} // Out of the trash, as for /save/
+			ops[i].Page = np
+		}
+		touched[req.Name] = true
+		touched[req.NewName] = true
+	}
+	return ops, nil
+}
+
+//
+// Batch Handler --
+//
+// POST localhost:8080/batch/  -- Applies a JSON list of Operations, all or none
+//
+//	[{"Op":"put","Name":"Ann","Body":"New Data"},
+//	 {"Op":"rename","Name":"Jack","NewName":"John"},
+//	 {"Op":"delete","Name":"Mike"},
+//	 {"Op":"put","Name":"Session","Body":"...","Expires":"30m"}]
+//
+// Answers {"Applied":N}, or the Operation that failed with 400 Bad Request
+// (409 Conflict when a Version was stale). A put without a Version that
+// only lost a race with another save is retried. A delete removes the
+// Page for good -- Only /delete/ moves it to the trash (see trash.go).
+//
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"Error": "POST a JSON list of operations"})
+		return
+	}
+	var reqs []batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"Error": err.Error()})
+		return
+	}
+	for {
+		ops, err := batchOps(reqs)
+		if err == nil {
+			err = db.Apply(ops)
+		}
+		if err == nil {
+			json.NewEncoder(w).Encode(map[string]int{"Applied": len(reqs)})
+			return
+		}
+		be, ok := err.(*batchError)
+		if !ok {
+			check("Batch Failed", err)
+		}
+		if be.Err == errConflict && reqs[be.Index].Version == 0 {
+			continue // Saved by someone else since batchOps -- Build the revisions again
+		}
+		status := http.StatusBadRequest
+		if be.Err == errConflict {
+			status = http.StatusConflict
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Failed int
+			Op     batchRequest
+			Error  string
+		}{be.Index, reqs[be.Index], be.Err.Error()})
+		return
+	}
+}
@@ -0,0 +1,189 @@
+// batch_test - Test Suite for the db_demo Atomic Batches.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Names and Bodies of a database, in Index order
+//
+func namesAndBodies(pages []Page) []string {
+	var out []string
+	for _, p := range pages {
+		out = append(out, p.Name+"="+string(p.Body))
+	}
+	return out
+}
+
+//
+// Test Apply -- A good Batch lands in full, a bad one not at all
+//
+func TestApply(t *testing.T) {
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+	for _, kind := range []string{"file", "disk", "dir", "memory"} {
+		removeDatabase()
+		*storageKind = kind
+		loadDatabase()
+		jack, _ := db.Get("Jack")
+
+		good := []Op{
+			{Op: "put", Page: Page{Name: "Henry", Body: []byte("Henry Data")}},
+			{Op: "rename", Name: "Jack", NewName: "John"},
+			{Op: "put", Page: Page{Name: "Jack", Body: []byte("New Jack")}}, // Old Name is free again
+			{Op: "delete", Name: "Mike"},
+		}
+		if err := db.Apply(good); err != nil {
+			t.Fatalf("%s: Apply = %v", kind, err)
+		}
+		want := []string{"Charles=Charles Data", "Ann=Ann Data", "John=Jack Data", "Jacky=Jacky Data", "Henry=Henry Data", "Jack=New Jack"}
+		if got := namesAndBodies(db.List()); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: after Apply\n\tExpected:\t%q\n\tGot:\t%q", kind, want, got)
+		}
+		if john, _ := db.Get("John"); john.ID != jack.ID || john.Version != jack.Version+1 {
+			t.Errorf("%s: rename changed the ID or Version: %v", kind, john)
+		}
+
+		bad := []struct {
+			ops   []Op
+			index int
+			err   error
+		}{
+			{[]Op{{Op: "delete", Name: "Ann"}, {Op: "delete", Name: "Ann"}}, 1, errNotFound},
+			{[]Op{{Op: "put", Page: Page{Name: "Ann"}}, {Op: "rename", Name: "Ann", NewName: "John"}}, 1, errNameTaken},
+			{[]Op{{Op: "rename", Name: "Ann", NewName: ""}}, 0, errBlankName},
+			{[]Op{{Op: "put", Page: Page{Name: "Ann", Body: []byte("x")}}, {Op: "put", Page: Page{Name: "Ann", Version: 1}}}, 1, errConflict},
+			{[]Op{{Op: "delete", Name: "Charles"}, {Op: "put", Page: Page{Name: "Zed", ID: jack.ID}}}, 1, errDuplicateID},
+			{[]Op{{Op: "delete", Name: "Charles"}, {Op: "copy", Name: "Ann"}}, 1, nil},
+		}
+		for _, c := range bad {
+			err := db.Apply(c.ops)
+			be, ok := err.(*batchError)
+			if !ok || be.Index != c.index || (c.err != nil && be.Err != c.err) {
+				t.Errorf("%s: Apply(%v) = %v; Expected operation %d: %v", kind, c.ops, err, c.index, c.err)
+			}
+			if got := namesAndBodies(db.List()); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: refused Batch changed the database: %q", kind, got)
+			}
+		}
+
+		if kind == "file" {
+			data, err := ioutil.ReadFile("Data.log")
+			testCheck(err)
+			if n := bytes.Count(data, []byte("\n")); n != 2 {
+				t.Errorf("Data.log has %d records, Expected base and one batch", n)
+			}
+		}
+		if kind != "memory" {
+			before := db.List()
+			loadDatabase() // Replay
+			if !reflect.DeepEqual(db.List(), before) {
+				t.Error("\nReplayed = ", db.List(), "\nExpected = ", before)
+			}
+		}
+	}
+	removeDatabase()
+}
+
+//
+// Test hidden Pages in a Batch -- Not found by delete or rename; a rename onto the Name purges them
+//
+func TestApplyHidden(t *testing.T) {
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+	defer removeDatabase()
+	hide := []struct {
+		how  string
+		hide func(name string)
+	}{
+		{"expired", func(name string) {
+			p, _ := db.Get(name)
+			p.Expires = now().Add(-time.Second)
+			testCheck(db.Put(p))
+		}},
+		{"trashed", func(name string) {
+			testCheck(trashPage(db, name, now()))
+		}},
+	}
+	for _, kind := range []string{"file", "disk", "dir", "memory"} {
+		for _, h := range hide {
+			removeDatabase()
+			*storageKind = kind
+			loadDatabase()
+			h.hide("Ann")
+
+			for _, ops := range [][]Op{{{Op: "delete", Name: "Ann"}}, {{Op: "rename", Name: "Ann", NewName: "Zed"}}} {
+				if err := db.Apply(ops); opError(err) != errNotFound {
+					t.Errorf("%s, %s: Apply(%v) = %v; Expected %v", kind, h.how, ops, err, errNotFound)
+				}
+			}
+			if err := db.Delete("Ann"); err != errNotFound {
+				t.Errorf("%s, %s: Delete = %v; Expected %v", kind, h.how, err, errNotFound)
+			}
+			if err := db.Apply([]Op{{Op: "rename", Name: "Mike", NewName: "Ann"}}); err != nil {
+				t.Errorf("%s, %s: rename onto the Name = %v", kind, h.how, err)
+			}
+			want := []string{"Charles=Charles Data", "Jack=Jack Data", "Ann=Mike Data", "Jacky=Jacky Data"}
+			if got := namesAndBodies(db.List()); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s, %s:\n\tExpected:\t%q\n\tGot:\t%q", kind, h.how, want, got)
+			}
+			if kind != "memory" {
+				before := db.List()
+				loadDatabase() // Replay -- The purge was logged with the rename
+				if !reflect.DeepEqual(db.List(), before) {
+					t.Errorf("%s, %s:\nReplayed = %v\nExpected = %v", kind, h.how, db.List(), before)
+				}
+			}
+		}
+	}
+}
+
+//
+// Test /batch/ -- JSON in, the failing Operation out
+//
+func TestBatchHandler(t *testing.T) {
+	testDatabase([]byte(cajmj_db))
+	cases := []struct {
+		method string
+		body   string
+		code   int
+		answer string
+	}{
+		{"GET", "", http.StatusMethodNotAllowed, "POST a JSON list"},
+		{"POST", "[{\"Op\":\"put\"", http.StatusBadRequest, "unexpected EOF"},
+		{"POST", "[{\"Op\":\"put\",\"Name\":\"Ann\",\"Body\":\"Ann 2\"},{\"Op\":\"rename\",\"Name\":\"Mike\",\"NewName\":\"Michael\"}]", http.StatusOK, "{\"Applied\":2}"},
+		{"POST", "[{\"Op\":\"put\",\"Name\":\"Ann\",\"Body\":\"Ann 3\"},{\"Op\":\"delete\",\"Name\":\"Mike\"}]", http.StatusBadRequest, "\"Failed\":1"},
+		{"POST", "[{\"Op\":\"put\",\"Name\":\"Ann\",\"Body\":\"Ann 3\",\"Version\":1}]", http.StatusConflict, "page changed since it was read"},
+		{"POST", "[{\"Op\":\"delete\",\"Name\":\"Jack\"},{\"Op\":\"put\",\"Name\":\"Jack\",\"Body\":\"Jack 2\"}]", http.StatusOK, "{\"Applied\":2}"},
+		{"POST", "[{\"Op\":\"trash\",\"Name\":\"Charles\"}]", http.StatusBadRequest, "unknown operation \\\"trash\\\""}, // Only for the Trash
+	}
+	for _, c := range cases {
+		w := testRequest(batchHandler, c.method, "/batch/", c.body)
+		if w.Code != c.code || !strings.Contains(w.Body.String(), c.answer) {
+			t.Errorf("%s %.40s = %d %q; Expected %d %q", c.method, c.body, w.Code, w.Body.String(), c.code, c.answer)
+		}
+	}
+	want := []string{"Charles=Charles Data", "Ann=Ann 2", "Michael=Mike Data", "Jacky=Jacky Data", "Jack=Jack 2"}
+	if got := namesAndBodies(db.List()); !reflect.DeepEqual(got, want) {
+		t.Errorf("\n\tExpected:\t%q\n\tGot:\t%q", want, got)
+	}
+	if ann, _ := db.Get("Ann"); ann.Rev != 1 || len(ann.History) != 1 {
+		t.Errorf("Batch put kept no revision: %v", ann)
+	}
+
+	var answer struct {
+		Failed int
+		Op     batchRequest
+	}
+	w := testRequest(batchHandler, "POST", "/batch/", "[{\"Op\":\"rename\",\"Name\":\"Nobody\",\"NewName\":\"X\"}]")
+	testCheck(json.Unmarshal(w.Body.Bytes(), &answer))
+	if answer.Failed != 0 || answer.Op.Name != "Nobody" {
+		t.Errorf("Failure answer = %+v", answer)
+	}
+}
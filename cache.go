@@ -0,0 +1,96 @@
+// cache - LRU Cache of Page Bodies for the Disk Storage.
+// Holds the Bodies (and revisions) read from disk most recently, up to a
+// limit in bytes. The least recently used entries are dropped first.
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+type cacheEntry struct { // One cached record
+	ref     recordRef  // Key -- A record never changes once written
+	body    []byte     // Page Body
+	history []Revision // Page revisions
+	size    int64      // Bytes held: Body and revision Bodies
+}
+
+type lruCache struct { // Byte-bounded LRU Cache
+	mu      sync.Mutex                  // Lookups move entries, so readers lock too
+	limit   int64                       // Most bytes held at once
+	size    int64                       // Bytes held now
+	order   *list.List                  // Most recently used first
+	entries map[recordRef]*list.Element // ref ==> Element holding its *cacheEntry
+	hits    int64                       // Lookups found
+	misses  int64                       // Lookups read from disk
+}
+
+//
+// New LRU Cache holding at most limit bytes
+//
+func newLRUCache(limit int64) *lruCache {
+	return &lruCache{limit: limit, order: list.New(), entries: map[recordRef]*list.Element{}}
+}
+
+//
+// Get -- Cached Body and revisions of a record, now most recently used
+//
+func (c *lruCache) get(ref recordRef) ([]byte, []Revision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[ref]
+	if !ok {
+		c.misses++
+		return nil, nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(el)
+	e := el.Value.(*cacheEntry)
+	return e.body, e.history, true
+}
+
+//
+// Add -- Cache a record, dropping the least recently used ones to stay under the limit
+//
+// A record bigger than the whole limit is not cached at all.
+//
+func (c *lruCache) add(ref recordRef, body []byte, history []Revision) {
+	size := int64(len(body))
+	for _, r := range history {
+		size += int64(len(r.Body))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[ref]; ok || size > c.limit {
+		return
+	}
+	c.entries[ref] = c.order.PushFront(&cacheEntry{ref: ref, body: body, history: history, size: size})
+	c.size += size
+	for c.size > c.limit {
+		oldest := c.order.Back()
+		e := oldest.Value.(*cacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, e.ref)
+		c.size -= e.size
+	}
+}
+
+//
+// Clear -- Drop every entry, keep the counters
+//
+func (c *lruCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = map[recordRef]*list.Element{}
+	c.size = 0
+}
+
+//
+// Stats -- Bytes held, entries, hits and misses
+//
+func (c *lruCache) stats() (size int64, entries int, hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size, len(c.entries), c.hits, c.misses
+}
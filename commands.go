@@ -0,0 +1,145 @@
+// commands - Offline Subcommands for the db_demo database.
+// Run instead of the Server; like it they hold Data.lock (see lock.go):
+//
+//	db_demo convert -to binary|json [-out file] [-key-file key]
+//	db_demo fsck [-repair] [-file Data.db] [-key-file key]
+//	db_demo rekey [-key-file old] -new-key-file new
+//
+// The key of an encrypted database comes from -key-file or $DB_DEMO_KEY.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+//
+// Run the Subcommand name -- Returns false if name is not a Subcommand
+//
+func runCommand(name string, args []string) bool {
+	commands := map[string]func([]string) error{
+		"convert": convertCommand,
+		"fsck":    fsckCommand,
+		"rekey":   rekeyCommand,
+	}
+	command, ok := commands[name]
+	if !ok {
+		return false
+	}
+	mustLockDatabase() // Not while the Server or another Subcommand runs
+	if err := command(args); err != nil {
+		fmt.Fprintln(os.Stderr, name+":", err)
+		os.Exit(1)
+	}
+	return true
+}
+
+//
+// Convert -- Rewrite Data.db in another encoding
+//
+// Data.log is folded in first. Without -out, Data.db is replaced in place;
+// with -out, a converted copy is written and Data.db is left alone.
+//
+func convertCommand(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	to := fs.String("to", "binary", "Encoding to convert to: json or binary")
+	out := fs.String("out", "", "Write the converted database to this file instead of replacing "+dataFile)
+	key := fs.String("key-file", "", "Key of an encrypted database (or set "+keyEnv+")")
+	fs.Parse(args)
+	if err := useKey(*key); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(dataFile)
+	if err != nil {
+		return err // Nothing to convert -- Never create the test data here
+	}
+	s, err := openFileStorage(dataFile, *to)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	target := dataFile
+	if len(*out) > 0 {
+		target = *out
+		data, err := encodeSnapshot(s.List(), *to)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(target, data, 0644)
+	} else {
+		err = s.checkpoint() // Snapshot in the new encoding, Log folded in
+	}
+	if err != nil {
+		return err
+	}
+	after, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d pages, %d bytes ==> %s (%s): %d bytes\n",
+		dataFile, len(s.List()), info.Size(), target, *to, after.Size())
+	return nil
+}
+
+//
+// Fsck -- Check Data.db record by record, optionally repair it
+//
+// Exits with an error when problems are found and -repair was not given.
+//
+func fsckCommand(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "Quarantine bad records and rebuild the Index sequence")
+	file := fs.String("file", dataFile, "Database file to check")
+	key := fs.String("key-file", "", "Key of an encrypted database (or set "+keyEnv+")")
+	fs.Parse(args)
+	if err := useKey(*key); err != nil {
+		return err
+	}
+
+	problems, err := fsck(*file, *repair, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if problems > 0 && !*repair {
+		return fmt.Errorf("%s has %d problems", *file, problems)
+	}
+	return nil
+}
+
+//
+// Rekey -- Re-encrypt Data.db (with Data.log) and Data.pages with a new key
+//
+// The old key comes from -key-file or $DB_DEMO_KEY; without one the
+// database is taken to be plain, so rekey also turns encryption on.
+//
+func rekeyCommand(args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	oldFile := fs.String("key-file", "", "Current key (or set "+keyEnv+") -- None for a plain database")
+	newFile := fs.String("new-key-file", "", "New key")
+	fs.Parse(args)
+	if len(*newFile) <= 0 {
+		return fmt.Errorf("-new-key-file is required")
+	}
+	oldKey, err := loadKey(*oldFile, os.Getenv(keyEnv))
+	if err != nil {
+		return err
+	}
+	newKey, err := loadKey(*newFile, "")
+	if err != nil {
+		return err
+	}
+	return rekey(oldKey, newKey)
+}
+
+//
+// Use the key from file or $DB_DEMO_KEY for a Subcommand
+//
+func useKey(file string) error {
+	key, err := loadKey(file, os.Getenv(keyEnv))
+	dataKey = key
+	return err
+}
@@ -0,0 +1,200 @@
+// compress - Page Body Compression on Disk.
+// Bodies (and revision Bodies) of at least -compress-min bytes are stored
+// compressed with -compress, and each record says how it was compressed,
+// so a database can hold a mix and the setting can change at any time.
+// Pages are compressed as they are written to Data.db, Data.log or
+// Data.pages and expanded as they are read; in memory, and so to every
+// handler, a Body is always plain.
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+var compressAlgo = flag.String("compress", "flate", "Body compression on disk: flate, gzip or none")
+var compressMin = flag.Int("compress-min", 1024, "Bodies smaller than this many bytes are stored uncompressed")
+
+type compressionStats struct { // Bodies written since startup
+	Bodies      int64 // Bodies written
+	Compressed  int64 // ... of them stored compressed
+	RawBytes    int64 // Their size in memory
+	StoredBytes int64 // Their size as written
+}
+
+var packStats compressionStats // Updated atomically by packBody
+
+//
+// Bodies written since startup -- A consistent enough copy of packStats
+//
+func writtenStats() compressionStats {
+	return compressionStats{
+		Bodies:      atomic.LoadInt64(&packStats.Bodies),
+		Compressed:  atomic.LoadInt64(&packStats.Compressed),
+		RawBytes:    atomic.LoadInt64(&packStats.RawBytes),
+		StoredBytes: atomic.LoadInt64(&packStats.StoredBytes),
+	}
+}
+
+//
+// Check a -compress setting
+//
+func checkCompression(algo string) error {
+	switch algo {
+	case "flate", "gzip", "none":
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q (flate, gzip or none)", algo)
+}
+
+//
+// Compress a Body for disk -- Returns it with its compression, "" if stored as is
+//
+// Small Bodies and Bodies that do not shrink are stored as they are.
+//
+func packBody(body []byte) ([]byte, string) {
+	stored, algo := body, ""
+	if len(body) >= *compressMin && *compressAlgo != "none" {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		if *compressAlgo == "gzip" {
+			w = gzip.NewWriter(&buf)
+		} else {
+			w, _ = flate.NewWriter(&buf, flate.DefaultCompression) // Fails only for a bad level
+		}
+		w.Write(body) // Cannot fail -- Writes into memory
+		w.Close()
+		if buf.Len() < len(body) {
+			stored, algo = buf.Bytes(), *compressAlgo
+		}
+	}
+	atomic.AddInt64(&packStats.Bodies, 1)
+	if len(algo) > 0 {
+		atomic.AddInt64(&packStats.Compressed, 1)
+	}
+	atomic.AddInt64(&packStats.RawBytes, int64(len(body)))
+	atomic.AddInt64(&packStats.StoredBytes, int64(len(stored)))
+	return stored, algo
+}
+
+//
+// Expand a Body read from disk
+//
+func unpackBody(body []byte, algo string) ([]byte, error) {
+	var r io.Reader
+	switch algo {
+	case "":
+		return body, nil
+	case "flate":
+		r = flate.NewReader(bytes.NewReader(body))
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	default:
+		return nil, fmt.Errorf("unknown compression %q", algo)
+	}
+	return ioutil.ReadAll(r)
+}
+
+//
+// Page as written to disk -- Body and revision Bodies compressed
+//
+// Sum must already be set: it covers the plain Bodies.
+//
+func packPage(p Page) Page {
+	p.Body, p.Compressed = packBody(p.Body)
+	if len(p.History) > 0 {
+		history := make([]Revision, len(p.History)) // Never change the stored Page
+		for i, r := range p.History {
+			r.Body, r.Compressed = packBody(r.Body)
+			history[i] = r
+		}
+		p.History = history
+	}
+	return p
+}
+
+//
+// Page as read from disk -- Bodies expanded before the Sum is checked
+//
+func unpackPage(p *Page) error {
+	body, err := unpackBody(p.Body, p.Compressed)
+	if err != nil {
+		return fmt.Errorf("%q: %s body: %v", p.Name, p.Compressed, err)
+	}
+	p.Body, p.Compressed = body, ""
+	for i := range p.History {
+		r := &p.History[i]
+		body, err := unpackBody(r.Body, r.Compressed)
+		if err != nil {
+			return fmt.Errorf("%q: revision %d: %s body: %v", p.Name, r.Rev, r.Compressed, err)
+		}
+		r.Body, r.Compressed = body, ""
+	}
+	return nil
+}
+
+//
+// Space a Data.db file saves -- Stored and plain Body bytes of every record
+//
+func fileCompression(data []byte) (compressionStats, error) {
+	var st compressionStats
+	records, _, err := snapshotRecords(data)
+	if err != nil {
+		return st, err
+	}
+	for i, raw := range records {
+		var stored, p Page // As stored, and expanded
+		if err := json.Unmarshal(raw, &stored); err != nil {
+			return st, fmt.Errorf("record %d: %v", i, err)
+		}
+		json.Unmarshal(raw, &p)
+		if err := unpackPage(&p); err != nil {
+			return st, fmt.Errorf("record %d: %v", i, err)
+		}
+		st.add(stored.Body, stored.Compressed, p.Body)
+		for j, r := range stored.History {
+			st.add(r.Body, r.Compressed, p.History[j].Body)
+		}
+	}
+	return st, nil
+}
+
+//
+// Count one Body
+//
+func (st *compressionStats) add(stored []byte, algo string, plain []byte) {
+	st.Bodies++
+	if len(algo) > 0 {
+		st.Compressed++
+	}
+	st.RawBytes += int64(len(plain))
+	st.StoredBytes += int64(len(stored))
+}
+
+type compressionReport struct { // Stats with the space they save
+	compressionStats
+	SavedBytes   int64   // RawBytes - StoredBytes
+	SavedPercent float64 // ... of RawBytes
+}
+
+//
+// Report -- Stats with the bytes saved, and as a percentage of the plain size
+//
+func (st compressionStats) report() compressionReport {
+	r := compressionReport{compressionStats: st, SavedBytes: st.RawBytes - st.StoredBytes}
+	if st.RawBytes > 0 {
+		r.SavedPercent = 100 * float64(r.SavedBytes) / float64(st.RawBytes)
+	}
+	return r
+}
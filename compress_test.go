@@ -0,0 +1,157 @@
+// compress_test - Test Suite for the db_demo Body Compression.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+//
+// Test Body compression -- Only large Bodies that shrink, and always back the same
+//
+func TestPackBody(t *testing.T) {
+	defer func(algo string, min int) { *compressAlgo, *compressMin = algo, min }(*compressAlgo, *compressMin)
+	*compressMin = 1024
+	text := bytes.Repeat([]byte("All work and no play makes Jack a dull boy. "), 100)
+	noise := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(noise)
+
+	cases := []struct {
+		algo string
+		body []byte
+		want string // Compression recorded
+	}{
+		{"flate", text, "flate"},
+		{"gzip", text, "gzip"},
+		{"none", text, ""},
+		{"flate", text[:1000], ""}, // Below -compress-min
+		{"flate", noise, ""},       // Does not shrink
+		{"flate", nil, ""},
+	}
+	for _, c := range cases {
+		*compressAlgo = c.algo
+		stored, algo := packBody(c.body)
+		if algo != c.want || (len(algo) > 0) != (len(stored) < len(c.body)) {
+			t.Errorf("%s, %d bytes: stored %d bytes as %q, Expected %q", c.algo, len(c.body), len(stored), algo, c.want)
+		}
+		body, err := unpackBody(stored, algo)
+		if err != nil || !bytes.Equal(body, c.body) {
+			t.Errorf("%s, %d bytes: unpacked %d bytes, %v", c.algo, len(c.body), len(body), err)
+		}
+	}
+	if _, err := unpackBody([]byte("not flate"), "flate"); err == nil {
+		t.Error("damaged flate body expanded")
+	}
+}
+
+//
+// Test compressed storage -- On disk compressed, to the handlers plain
+//
+func TestCompressedStorage(t *testing.T) {
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+	body := strings.Repeat("Large page body, saved again and again. ", 100)
+	for _, kind := range []string{"file", "disk"} {
+		removeDatabase()
+		*storageKind = kind
+		loadDatabase()
+		testRequest(saveHandler, "POST", "/save/Ann", "body="+body)
+		testRequest(saveHandler, "POST", "/save/Ann", "body="+body+"!") // First one into History
+
+		files := map[string]string{"file": "Data.log", "disk": pagesFile}
+		data, err := ioutil.ReadFile(files[kind])
+		testCheck(err)
+		if bytes.Contains(data, []byte(b64(body))) || bytes.Count(data, []byte(`"Compressed":"flate"`)) < 2 {
+			t.Errorf("%s: %s holds the plain Body: %d bytes", kind, files[kind], len(data))
+		}
+		if kind == "file" {
+			testCheck(db.(*fileStorage).checkpoint())
+			data, err = ioutil.ReadFile(dataFile)
+			testCheck(err)
+			if bytes.Contains(data, []byte(b64(body))) {
+				t.Errorf("%s: Data.db holds the plain Body", kind)
+			}
+		}
+
+		for i := 0; i < 2; i++ { // Before and after a reload
+			view := testRequest(viewHandler, "GET", "/view/Ann", "").Body.String()
+			edit := testRequest(editHandler, "GET", "/edit/Ann", "").Body.String()
+			if !strings.Contains(view, body+"!") || !strings.Contains(edit, body+"!") {
+				t.Errorf("%s: view or edit does not show the plain Body", kind)
+			}
+			if old := testRequest(viewHandler, "GET", "/view/Ann?rev=2", "").Body.String(); !strings.Contains(old, body) {
+				t.Errorf("%s: revision 2 not expanded", kind)
+			}
+			loadDatabase()
+		}
+	}
+	removeDatabase()
+}
+
+//
+// Test a damaged compressed Body -- Refused on load, reported by fsck
+//
+func TestCompressedDamage(t *testing.T) {
+	pages := testData()
+	pages[1].Body = bytes.Repeat([]byte("Ann Data "), 200)
+	data, err := encodeSnapshot(pages, "json")
+	testCheck(err)
+	var h dataHeader
+	testCheck(json.Unmarshal(data, &h))
+	if h.Pages[1].Compressed != "flate" {
+		t.Fatalf("Ann stored as %q", h.Pages[1].Compressed)
+	}
+	h.Pages[1].Body = h.Pages[1].Body[:len(h.Pages[1].Body)/2]
+	data, err = json.Marshal(h)
+	testCheck(err)
+
+	if _, _, err := decodeSnapshot(data); err == nil || !strings.Contains(err.Error(), "flate body") {
+		t.Errorf("damaged Body decoded: %v", err)
+	}
+	removeDatabase()
+	defer removeDatabase()
+	testCheck(ioutil.WriteFile(dataFile, data, 0644))
+	var out bytes.Buffer
+	if problems, err := fsck(dataFile, false, &out); problems != 1 || err != nil || !strings.Contains(out.String(), "cannot be expanded") {
+		t.Errorf("fsck = %d, %v: %s", problems, err, out.String())
+	}
+}
+
+//
+// Test the compression stats -- Space saved by Data.db and since startup
+//
+func TestCompressionStats(t *testing.T) {
+	pages := testData()
+	pages[1].Body = bytes.Repeat([]byte("Ann Data "), 200)
+	data, err := encodeSnapshot(pages, "binary")
+	testCheck(err)
+	st, err := fileCompression(data)
+	testCheck(err)
+	r := st.report()
+	raw := 0
+	for _, p := range pages {
+		raw += len(p.Body)
+	}
+	if st.Bodies != 5 || st.Compressed != 1 || st.RawBytes != int64(raw) {
+		t.Errorf("Data.db stats = %+v", r)
+	}
+	if r.SavedBytes != st.RawBytes-st.StoredBytes || r.SavedPercent <= 50 {
+		t.Errorf("saved %d bytes, %.1f%%", r.SavedBytes, r.SavedPercent)
+	}
+
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+	removeDatabase()
+	defer removeDatabase()
+	*storageKind = "file"
+	loadDatabase()
+	testRequest(saveHandler, "POST", "/save/Ann", "body="+strings.Repeat("x", 5000))
+	testCheck(db.(*fileStorage).checkpoint())
+	var res map[string]compressionReport
+	testCheck(json.Unmarshal(testRequest(statsHandler, "GET", "/admin/stats", "").Body.Bytes(), &res))
+	if res["Written"].Compressed <= 0 || res["DataFile"].Bodies != 6 || res["DataFile"].SavedBytes < 4000 {
+		t.Errorf("stats = %+v", res)
+	}
+}
@@ -0,0 +1,262 @@
+// crypt - Encryption at Rest (AES-256-GCM).
+// With a key from -key-file or $DB_DEMO_KEY, Data.db and saved snapshots
+// are sealed as a whole, and every record of Data.log and Data.pages (and
+// the Data.pages index) on its own. Each sealed piece starts with the ID
+// of the key that sealed it, so a wrong key is named as such instead of
+// looking like damage. Plain files still load with a key set and are
+// sealed the next time they are written; "db_demo rekey" re-encrypts the
+// database offline with a new key.
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+var keyFile = flag.String("key-file", "", "File holding the AES-256 key for encryption at rest (or set "+keyEnv+")")
+
+const keyEnv = "DB_DEMO_KEY" // Environment variable holding the key
+
+const sealedMagic = "\x00DBDEMO-SEALED\n" // Start of a sealed Data.db -- Never valid JSON
+
+const keyIDSize = 8 // Bytes of the key ID in front of every sealed piece
+
+var dataKey []byte // Key in use -- nil: Nothing is sealed
+
+type keyError struct { // Sealed data the key in use cannot open
+	msg string
+}
+
+func (e keyError) Error() string { return e.msg }
+
+//
+// Load the key -- From file if given, else from env; nil for neither
+//
+// The key is 32 bytes, written as 64 hex digits or in base64.
+//
+func loadKey(file, env string) ([]byte, error) {
+	text, from := env, "$"+keyEnv
+	if len(file) > 0 {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text, from = string(data), file
+	}
+	text = string(bytes.TrimSpace([]byte(text)))
+	if len(text) <= 0 {
+		if len(file) > 0 {
+			return nil, fmt.Errorf("%s: empty key", from)
+		}
+		return nil, nil // No encryption
+	}
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: key must be 32 bytes as 64 hex digits or base64", from)
+}
+
+//
+// Key ID -- Start of the SHA-256 of the key, never the key itself
+//
+func keyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:keyIDSize]
+}
+
+//
+// Seal data with key -- Key ID, nonce, then the AES-GCM ciphertext
+//
+func seal(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, keyID(key)...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, data, nil), nil
+}
+
+//
+// Open data sealed by seal -- A keyError if key is not the one it was sealed with
+//
+func unseal(key, sealed []byte, what string) ([]byte, error) {
+	if key == nil {
+		return nil, keyError{what + " is encrypted - give its key with -key-file or $" + keyEnv}
+	}
+	if len(sealed) < keyIDSize || !bytes.Equal(sealed[:keyIDSize], keyID(key)) {
+		return nil, keyError{what + " was encrypted with a different key"}
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[keyIDSize:]
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%s: sealed data truncated", what)
+	}
+	data, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: sealed data damaged: %v", what, err)
+	}
+	return data, nil
+}
+
+//
+// AES-256-GCM for key
+//
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//
+// Seal a whole file (Data.db, an index) with the key in use -- As is without one
+//
+func sealFile(data []byte) ([]byte, error) {
+	if dataKey == nil {
+		return data, nil
+	}
+	sealed, err := seal(dataKey, data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(sealedMagic), sealed...), nil
+}
+
+//
+// Open a file sealed by sealFile -- A plain file is returned as it is
+//
+func unsealFile(data []byte, what string) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(sealedMagic)) {
+		return data, nil
+	}
+	return unseal(dataKey, data[len(sealedMagic):], what)
+}
+
+//
+// Seal one line of a file (a record) with the key in use -- {"Sealed":...}
+//
+func sealLine(data []byte) ([]byte, error) {
+	if dataKey == nil {
+		return data, nil
+	}
+	sealed, err := seal(dataKey, data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct{ Sealed []byte }{sealed})
+}
+
+//
+// Decode one line of Data.log or Data.pages -- Opening it if sealed
+//
+func decodeRecord(line []byte) (logRecord, error) {
+	var rec logRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return rec, err
+	}
+	if rec.Sealed == nil {
+		return rec, nil
+	}
+	data, err := unseal(dataKey, rec.Sealed, "record")
+	if err != nil {
+		return rec, err
+	}
+	rec = logRecord{}
+	return rec, json.Unmarshal(data, &rec)
+}
+
+//
+// Rekey -- Re-encrypt the database files with newKey, offline
+//
+// Data.db is folded together with Data.log and written twice, so
+// Data.db.prev is sealed with the new key too; Data.pages is rewritten
+// with its index, and every file in Data.dir. Files the old key sealed before (backups, quarantine)
+// are left alone.
+//
+func rekey(oldKey, newKey []byte) error {
+	defer func(key []byte) { dataKey = key }(dataKey)
+	done := 0
+	if data, err := ioutil.ReadFile(dataFile); err == nil {
+		dataKey = oldKey
+		plain, err := unsealFile(data, dataFile)
+		if err != nil {
+			return err
+		}
+		s, err := openFileStorage(dataFile, fileEncoding(plain)) // Encoding kept
+		if err != nil {
+			return err
+		}
+		dataKey = newKey
+		err = s.checkpoint()
+		if err == nil {
+			err = s.checkpoint() // Data.db.prev too
+		}
+		s.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Println("Re-encrypted", dataFile)
+		done++
+	}
+	if _, err := os.Stat(pagesFile); err == nil {
+		dataKey = oldKey
+		s, err := openDiskStorage(pagesFile, *cacheBytes)
+		if err != nil {
+			return err
+		}
+		pages := s.List() // Read with the old key
+		dataKey = newKey
+		err = s.Restore(pages)
+		if cerr := s.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("Re-encrypted", pagesFile)
+		done++
+	}
+	if _, err := os.Stat(pagesDir); err == nil {
+		dataKey = oldKey
+		s, err := openDirStorage(pagesDir)
+		if err != nil {
+			return err
+		}
+		dataKey = newKey
+		err = s.Restore(s.List())
+		if cerr := s.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("Re-encrypted", pagesDir)
+		done++
+	}
+	if done == 0 {
+		return fmt.Errorf("no %s, %s or %s to re-encrypt", dataFile, pagesFile, pagesDir)
+	}
+	return nil
+}
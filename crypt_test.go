@@ -0,0 +1,196 @@
+// crypt_test - Test Suite for the db_demo Encryption at Rest.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// Write a key file into dir -- 32 bytes of fill, hex encoded
+//
+func testKeyFile(dir string, fill byte) string {
+	file := filepath.Join(dir, fmt.Sprint("key", fill))
+	testCheck(ioutil.WriteFile(file, []byte(strings.Repeat(fmt.Sprintf("%02x", fill), 32)+"\n"), 0600))
+	return file
+}
+
+//
+// Test loading keys -- Hex or base64, 32 bytes, file before env
+//
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	files := map[string]string{
+		"hex":    strings.Repeat("07", 32),
+		"base64": base64.StdEncoding.EncodeToString(key) + "\n",
+		"short":  strings.Repeat("07", 16),
+		"empty":  "",
+	}
+	for name, text := range files {
+		testCheck(ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0600))
+	}
+	cases := []struct {
+		file string
+		env  string
+		want []byte
+		ok   bool
+	}{
+		{"hex", "", key, true},
+		{"base64", "", key, true},
+		{"short", "", nil, false},
+		{"empty", "", nil, false},
+		{"missing", "", nil, false},
+		{"", strings.Repeat("07", 32), key, true},
+		{"hex", "not a key", key, true}, // The file wins
+		{"", "", nil, true},             // No encryption
+	}
+	for _, c := range cases {
+		file := c.file
+		if len(file) > 0 {
+			file = filepath.Join(dir, file)
+		}
+		got, err := loadKey(file, c.env)
+		if !bytes.Equal(got, c.want) || (err == nil) != c.ok {
+			t.Errorf("loadKey(%q, %q) = %x, %v", c.file, c.env, got, err)
+		}
+	}
+}
+
+//
+// Test sealing -- Round trip, wrong key named, damage detected
+//
+func TestSeal(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	other := bytes.Repeat([]byte{2}, 32)
+	sealed, err := seal(key, []byte("Charles Data"))
+	testCheck(err)
+	if bytes.Contains(sealed, []byte("Charles")) {
+		t.Error("sealed data holds the plain text")
+	}
+	if data, err := unseal(key, sealed, "test"); err != nil || string(data) != "Charles Data" {
+		t.Errorf("unseal = %q, %v", data, err)
+	}
+	if _, err := unseal(other, sealed, "test"); !strings.Contains(errString(err), "different key") {
+		t.Errorf("wrong key: %v", err)
+	}
+	if _, err := unseal(nil, sealed, "test"); !strings.Contains(errString(err), "is encrypted") {
+		t.Errorf("no key: %v", err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := unseal(key, sealed, "test"); !strings.Contains(errString(err), "damaged") {
+		t.Errorf("damaged: %v", err)
+	}
+}
+
+//
+// Error text -- Empty for nil
+//
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+//
+// Test encrypted storage -- Nothing readable on disk, wrong key refused, never reseeded
+//
+func TestEncryptedStorage(t *testing.T) {
+	defer func(kind, file string) { *storageKind, *keyFile = kind, file }(*storageKind, *keyFile)
+	defer func() { dataKey = nil }()
+	dir := t.TempDir()
+	files := map[string][]string{
+		"file": {dataFile, "Data.log"},
+		"disk": {pagesFile, pagesFile + ".idx"},
+		"dir":  {filepath.Join(pagesDir, pageFileName("Henry")), filepath.Join(pagesDir, pageFileName("Charles"))},
+	}
+	for _, kind := range []string{"file", "disk", "dir"} {
+		removeDatabase()
+		*storageKind, *keyFile = kind, testKeyFile(dir, 1)
+		loadDatabase()
+		testCheck(db.Put(Page{Name: "Henry", Body: []byte("Secret Data")}))
+		want := namesAndBodies(db.List())
+		db.Close()
+		db = nil
+
+		before := map[string][]byte{}
+		for _, file := range files[kind] {
+			data, err := ioutil.ReadFile(file)
+			testCheck(err)
+			before[file] = data
+			if bytes.Contains(data, []byte("Henry")) || bytes.Contains(data, []byte(b64("Secret Data"))) || bytes.Contains(data, []byte("Charles")) {
+				t.Errorf("%s: %s is readable", kind, file)
+			}
+		}
+
+		for _, c := range []struct{ key, err string }{
+			{testKeyFile(dir, 2), "different key"},
+			{"", "is encrypted"},
+		} {
+			*keyFile = c.key
+			if s, err := openStorage(kind); !strings.Contains(errString(err), c.err) {
+				t.Errorf("%s, key %q: openStorage = %v, Expected %q", kind, c.key, err, c.err)
+				if s != nil {
+					s.Close()
+				}
+			}
+			for file, data := range before {
+				if now, _ := ioutil.ReadFile(file); !bytes.Equal(now, data) {
+					t.Errorf("%s: %s changed by a refused load", kind, file)
+				}
+			}
+		}
+
+		*keyFile = testKeyFile(dir, 1)
+		loadDatabase()
+		if got := namesAndBodies(db.List()); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: reloaded\n\tExpected:\t%q\n\tGot:\t%q", kind, want, got)
+		}
+	}
+	removeDatabase()
+}
+
+//
+// Test rekey -- Plain to sealed, then to a new key; the old key stops working
+//
+func TestRekey(t *testing.T) {
+	defer func(kind, file string) { *storageKind, *keyFile = kind, file }(*storageKind, *keyFile)
+	defer func() { dataKey = nil }()
+	dir := t.TempDir()
+	for _, kind := range []string{"file", "disk", "dir"} {
+		removeDatabase()
+		*storageKind, *keyFile = kind, ""
+		loadDatabase()
+		testCheck(db.Put(Page{Name: "Henry", Body: []byte("Henry Data")}))
+		want := namesAndBodies(db.List())
+		db.Close()
+		db = nil
+
+		a, b := testKeyFile(dir, 3), testKeyFile(dir, 4)
+		keyA, _ := loadKey(a, "")
+		keyB, _ := loadKey(b, "")
+		testCheck(rekey(nil, keyA))
+		testCheck(rekey(keyA, keyB))
+		if dataKey != nil {
+			t.Error("rekey left a key in use")
+		}
+
+		*keyFile = a
+		if _, err := openStorage(kind); !strings.Contains(errString(err), "different key") {
+			t.Errorf("%s: old key: %v", kind, err)
+		}
+		*keyFile = b
+		loadDatabase()
+		if got := namesAndBodies(db.List()); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: after rekey\n\tExpected:\t%q\n\tGot:\t%q", kind, want, got)
+		}
+	}
+	removeDatabase()
+}
@@ -5,61 +5,72 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 )
 
-var xMem []Page // In Memory Database File
+var storageKind = flag.String("storage", "file", "Storage backend: file (Data.db), disk (Data.pages, Bodies read on demand), dir (Data.dir, one file per Page), sqlite (Data.sqlite, needs -tags sqlite) or memory")
+var dataEncoding = flag.String("encoding", "json", "Data.db encoding written: json or binary (both are read)")
 
 type Page struct { // Database Page
-	Index int    // Index of Database Page
+	ID    string `json:",omitempty"` // Stable ID (ULID) -- Assigned when the Page is created
+	Index int    // Display order of the Database Page -- Changes when Pages are deleted
 	Name  string // KEY: Name as Search Key
 	Body  []byte // VALUE: Data associated with the Key
+	Sum   uint32 `json:",omitempty"` // Checksum on disk (see pageSum) -- Zero in memory
+
+	Compressed string `json:",omitempty"` // How Body is compressed on disk (see compress.go) -- Empty in memory
+
+	Version int        `json:",omitempty"` // Bumped by every Put -- Sent as the ETag (see etag.go)
+	Rev     int        `json:",omitempty"` // Revision number of Body -- One more on every save
+	Saved   time.Time  `json:",omitzero"`  // When Body was saved -- Zero if before revisions
+	History []Revision `json:",omitempty"` // Earlier Bodies, oldest first (see history.go)
+	Expires time.Time  `json:",omitzero"`  // Gone after this time -- Zero never (see expiry.go)
+	Deleted time.Time  `json:",omitzero"`  // Moved to the trash at this time -- Zero if not (see trash.go)
 }
 
 func main() {
+	if len(os.Args) > 1 && runCommand(os.Args[1], os.Args[2:]) {
+		return // Offline Subcommand -- No Server
+	}
+	flag.Parse()
 	fmt.Println("Starting Database Server")
+	mustLockDatabase() // One Server per directory
 	//	http.HandleFunc("/", slashHandler) // Display Help Commands
 
 	loadDatabase()                         // Load Database
+	go expirySweeper(*sweepInterval)       // Delete expired Pages in the background
 	http.HandleFunc("/", slashHandler)     // Display Help Commands
 	http.HandleFunc("/view/", viewHandler) // Setup Handler Functions
+	http.HandleFunc("/id/", idHandler)
+	http.HandleFunc("/history/", historyHandler)
+	http.HandleFunc("/rollback/", rollbackHandler)
 	http.HandleFunc("/exit/", exitHandler)
 	http.HandleFunc("/edit/", editHandler)
 	http.HandleFunc("/save/", saveHandler)
 	http.HandleFunc("/delete/", deleteHandler)
+	http.HandleFunc("/batch/", batchHandler)
+	http.HandleFunc("/trash/", trashHandler)
+	http.HandleFunc("/restore/", trashRestoreHandler)
+	http.HandleFunc("/admin/snapshot", snapshotHandler)
+	http.HandleFunc("/admin/restore", restoreHandler)
+	http.HandleFunc("/admin/stats", statsHandler)
 	http.ListenAndServe(":8080", nil) // Setup up Server to listen on port 8080
 }
 
 //
-// Load Database
+// Load Database -- Open the Storage Backend selected at startup
 //
 func loadDatabase() {
-	//	var xMem []Page // Temporary Blank in-memory Database
-	data, err := ioutil.ReadFile("Data.db") // Load Database
-	if err != nil {                         // If missing - Create
-		//
-		// Create the Initial Database with Test Data - Remove appends below for empty database
-		//
-		xMem = append(xMem, Page{Index: 0, Name: "Charles", Body: []byte("Charles Data")})
-		xMem = append(xMem, Page{Index: 1, Name: "Ann", Body: []byte("Ann Data")})
-		xMem = append(xMem, Page{Index: 2, Name: "Jack", Body: []byte("Jack Data")})
-		xMem = append(xMem, Page{Index: 3, Name: "Mike", Body: []byte("Mike Data")})
-		xMem = append(xMem, Page{Index: 4, Name: "Jacky", Body: []byte("Jacky Data")})
-
-		data, err = json.Marshal(xMem) // Marshall Database
-		check("Marshalling Failed", err)
-		_, err := os.Create("Data.db") // Create Database
-		check("Create File Failed", err)
-		writeData(data)                   // Write Database
-		err = json.Unmarshal(data, &xMem) //Reload In-Memory Copy
-		check("Unmarshal Failed", err)
+	if db != nil {
+		db.Close() // Release the previous Backend
 	}
+	var err error
+	db, err = openStorage(*storageKind)
+	check("Load Database Failed", err)
 }
 
 //
@@ -72,51 +83,43 @@ func check(s string, e error) {
 	}
 }
 
+// Find Name Function - Locates by string.Contains (Trigram Index).
+// If more than one name matches, it searches again for an exact match (Hash Index)
+// Expired Pages are never found. Matches are told apart by their metadata;
+// only the Page returned is read in full.
 //
-// Write Data Set to Disk
-//
-func writeData(data []byte) { // Write "Mashalled" data to external device
-	err := ioutil.WriteFile("Data.db", data, 0644)
-	check("Write File Failed", err) // Error Check -- Panic if write fails
-}
-
-// Find Name Function - Locates by string.Contains.
-// If more than one name matches, it searches again with string.Compare Function (equality match)
-//
-func findName(xMem []Page, name string) (Page, bool) {
+func findName(s Storage, name string) (Page, bool) {
 	var retPg Page // Create Variables
 
-	dup := 0
-	for i, key := range xMem { // Search using string.Contains method
-		if strings.Contains(key.Name, name) {
-			dup++ // Increment variable dup for each match
-			retPg = xMem[i]
+	t := now()
+	var matches []string
+	for _, pg := range searchPages(s, name) { // Pages whose Name contains "name"
+		if live(pg, t) {
+			matches = append(matches, pg.Name)
+			retPg = pg
 		}
 	}
-	if dup != 1 { // Duplicate Search Result Check!
-		for i, key := range xMem { // Find exact match!
-			if strings.Compare(key.Name, name) == 0 {
-				retPg = xMem[i]    // If found - Store returned page
-				return retPg, true // Return Result and True (exact match found)
-			}
+	if len(matches) != 1 { // Duplicate Search Result Check!
+		if pg, ok := s.Get(name); ok && live(pg, t) { // Find exact match!
+			return pg, true // Return Result and True (exact match found)
 		}
 		return retPg, false // If no exact match return False
 	}
-	return retPg, true // Return Result and True (only one "contains" Result found)
+	if pg, ok := s.Get(matches[0]); ok && live(pg, t) { // Only one "contains" Result -- Read it in full
+		return pg, true
+	}
+	return Page{}, false // Gone since the Search
 }
 
 //
-// Find Name Function - Locates by string.Compare "equality" match
+// Find Name Function - Locates by "equality" match through the Hash Index
 //
-func findExactName(xMem []Page, name string) (Page, bool) {
-	var retPg Page             // Create Variables
-	for i, key := range xMem { // Search in-memory database for an exact match
-		if strings.Compare(key.Name, name) == 0 {
-			retPg = xMem[i]    // Match Found
-			return retPg, true // Return Page and bool return value of True
-		}
+func findExactName(s Storage, name string) (Page, bool) {
+	p, ok := s.Get(name) // Constant-time lookup
+	if !ok || !live(p, now()) {
+		return Page{}, false // Expired -- Gone until the Sweeper deletes it
 	}
-	return retPg, false // No match found -- Return bool return value of False
+	return p, true
 }
 
 //
@@ -130,8 +133,19 @@ func slashHandler(w http.ResponseWriter, r *http.Request) {
 		"localhost:8080/help/&emsp;&emsp;&emsp;&emsp;This Message<br>"+
 		"localhost:8080/exit/&emsp;<br>"+
 		"localhost:8080/view/name/&emsp;(name Optional)<br>"+
+		"localhost:8080/view/name?rev=N&emsp;(or ?at=TIME)<br>"+
+		"localhost:8080/id/ID/&emsp;<br>"+
+		"localhost:8080/history/name/&emsp;<br>"+
+		"localhost:8080/rollback/name?rev=N&emsp;(asks to confirm)<br>"+
 		"localhost:8080/edit/name/&emsp;<br>"+
-		"localhost:8080/delete/name/&emsp;  <br></h2>")
+		"localhost:8080/delete/name/&emsp;(to the trash)<br>"+
+		"localhost:8080/delete/ALL&emsp;(asks to confirm; ?dry-run=1 lists)<br>"+
+		"localhost:8080/trash/&emsp;<br>"+
+		"localhost:8080/restore/name/&emsp;(from the trash)<br>"+
+		"POST localhost:8080/batch/&emsp;(JSON list of put, delete and rename)<br>"+
+		"localhost:8080/admin/snapshot&emsp;(?save=1 writes to -snapshot-dir)<br>"+
+		"POST localhost:8080/admin/restore&emsp;(body is a snapshot)<br>"+
+		"localhost:8080/admin/stats&emsp;(space saved by compression)<br></h2>")
 	return
 }
 
@@ -160,35 +174,21 @@ func viewHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Create Variables
 	if len(name) <= 0 {
-		// Check for /view without name
+		// Check for /view without name -- The only View that lists the Database
+		xMem := livePages(db, now()) // Expired and deleted Pages are not listed
 		if len(xMem) <= 0 {
-			// Empty Database Check
-			body = fmt.Sprintln("")
-			// Create Empty TextArea
-		} else {
-			// Page Validation Check --
-			for i := 0; i < len(xMem); i++ {
-				if i != xMem[i].Index {
-					// Make sure in-memory index equals internal page index
-					// Database corruption error!
-					error := fmt.Sprintln("Database Indexing Failure: Name = ", xMem[i].Name)
-					fmt.Fprintf(w, "<h1>View: %s</h1>", error)
-					time.Sleep(time.Second)
-					return
-				}
-				// Display&emsp; Page Elements in Testarea of <form>
-				body += fmt.Sprintln("Record ", xMem[i].Index, ": ", xMem[i].Name, string(""))
-			}
-			// Send constructed Display to the Client!
-			fmt.Fprintf(w, "<h1>Database contains the following Names:</h1>"+
-				"<textarea nameM=\"body\" rows=\"20\" cols=\"80\">%s</textarea><br>"+
-				"</form>", body)
+			// Display Empty Database Message
+			fmt.Fprintf(w, "<h1>View: %s</h1>", "Empty Database")
 			return
 		}
-	}
-	// Display Empty Database Message
-	if len(xMem) <= 0 {
-		fmt.Fprintf(w, "<h1>View: %s</h1>", "Empty Database")
+		for i := 0; i < len(xMem); i++ {
+			// Display&emsp; Page Elements in Testarea of <form> -- Numbered without the hidden ones
+			body += fmt.Sprintln("Record ", i, ": ", xMem[i].Name, string(""))
+		}
+		// Send constructed Display to the Client!
+		fmt.Fprintf(w, "<h1>Database contains the following Names:</h1>"+
+			"<textarea nameM=\"body\" rows=\"20\" cols=\"80\">%s</textarea><br>"+
+			"</form>", body)
 		return
 	}
 	// Display "ALL" Error (Only for /delete/ALL)
@@ -197,19 +197,55 @@ func viewHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Handle Display of a "Named" Page
-	p, ok := findName(xMem, name)
+	p, ok := findName(db, name)
 	if !ok {
 		// Too many matches or Name not found
 		if len(p.Name) > 0 {
 			fmt.Fprintf(w, "<h1>View: %s</h1>", "Name Matches > 1!")
 			return
 		}
+		// Display Empty Database Message -- Only listed when nothing matched
+		if len(livePages(db, now())) <= 0 {
+			fmt.Fprintf(w, "<h1>View: %s</h1>", "Empty Database")
+			return
+		}
 		fmt.Fprintf(w, "<h1>View: %s</h1>", "Name not found!")
 		return
 	}
+	title := p.Name
+	rev, ask, msg := requestedRevision(r, p) // ?rev=N or ?at=TIME -- An earlier Body
+	if len(msg) > 0 {
+		fmt.Fprintf(w, "<h1>View: %s</h1>", msg)
+		return
+	}
+	if ask {
+		title = fmt.Sprintf("%s (revision %d)", p.Name, rev.Rev)
+		p.Body = rev.Body
+	} else {
+		w.Header().Set("ETag", etag(p)) // For If-Match on /save/
+	}
 
 	fmt.Fprintf(w, "<h1>View: %s</h1>"+
 		// Create <form> for viable “name” result
+		"<form action=\"/load/%s\" method=\"POST\">"+
+		"<textarea nameM=\"body\" rows=\"20\" cols=\"80\">%s</textarea><br>"+
+		"</form>",
+		title, p.Name, p.Body)
+}
+
+//
+// ID Handler --
+//
+// localhost:8080/id/ID  -- Displays the Page with this stable ID
+//
+func idHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Path[len("/id/"):]
+	p, ok := db.GetID(id)
+	if !ok || !live(p, now()) {
+		fmt.Fprintf(w, "<h1>View: %s</h1>", "ID not found!")
+		return
+	}
+	fmt.Fprintf(w, "<h1>View: %s</h1>"+
 		"<form action=\"/load/%s\" method=\"POST\">"+
 		"<textarea nameM=\"body\" rows=\"20\" cols=\"80\">%s</textarea><br>"+
 		"</form>",
@@ -219,13 +255,39 @@ func viewHandler(w http.ResponseWriter, r *http.Request) {
 ////
 // SaveHandler helper to create and store a new page in the database
 //
-func (p *Page) save() {
-	np := Page{Index: p.Index, Name: p.Name, Body: p.Body} // Create a database Page
-	xMem[p.Index] = np                                     // Append it to the in-memory database
-	data, err := json.Marshal(xMem)                        // Marshal the database
-	check("Marshalling Failed", err)                       // Check for error
-	writeData(data)                                        // Write database to the disk
-	return                                                 // Return
+// The Body it replaces is kept as a revision (see history.go). A non-zero
+// p.Version must still be current or errConflict is returned (see etag.go).
+// A new Page is only created if no one else created it first; if someone
+// did, it is saved over that one as a new revision.
+//
+func (p *Page) save() error {
+	for {
+		np := Page{ID: p.ID, Name: p.Name, Body: p.Body, Version: p.Version, Rev: 1, Saved: now()} // Create a database Page
+		old, ok := db.Get(p.Name)
+		if ok && !expired(old, np.Saved) { // Expired -- Start again, trashed -- Keep its history
+			if p.Version != 0 && p.Version != old.Version {
+				return errConflict // Changed since the Client read it
+			}
+			var changed bool
+			np, changed = nextRevision(old, p.Body)
+			if !changed && old.Expires.Equal(p.Expires) && old.Deleted.IsZero() {
+				return nil // Same Body and expiry -- Nothing to save
+			}
+			np.Version = old.Version // The revision was built from old
+		} else if np.Version == 0 {
+			np.Version = versionNew // Not there -- Created by someone else since the Get is a conflict
+			if ok {
+				np.Version = old.Version // Expired -- Replaced only as it was read
+			}
+		}
+		np.Expires = p.Expires
+		np.Deleted = time.Time{} // Saving a Page brings it back from the trash
+		err := db.Put(np)        // Store it in the database
+		if err != errConflict || p.Version != 0 {
+			return err
+		}
+		// Saved by someone else since the Get -- Build the revision again
+	}
 }
 
 // Save Handler Function -- Should not be used by the Client
@@ -236,17 +298,40 @@ func saveHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/view/", http.StatusFound)
 		return
 	}
-	pg, ok := findName(xMem, name) // Find "name"
-	if !ok {                       // If error - report it and panic
+	pg, ok := findName(db, name) // Find "name"
+	if !ok {                     // If error - report it and panic
 		http.Redirect(w, r, "/view/", http.StatusOK) //Redirect to /view/
 		return
 	}
 	body := r.FormValue("body") // Get <form> value for "body"
-	p := &Page{Index: pg.Index, Name: name, Body: []byte(body)}
+	version, ifMatch := expectedVersion(r, pg)
+	p := &Page{Index: pg.Index, Name: pg.Name, Body: []byte(body), Version: version, Expires: pg.Expires}
 	if len(body) <= 0 {
-		p = &Page{Index: pg.Index, Name: name, Body: pg.Body}
+		p = &Page{Index: pg.Index, Name: pg.Name, Body: pg.Body, Version: version, Expires: pg.Expires}
+	}
+	if _, ok := r.Form["expires"]; ok { // Not sent -- Keep the expiry
+		expires, err := parseExpires(r.FormValue("expires"), now())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "<h1>Save Error: %s</h1>", err)
+			return
+		}
+		p.Expires = expires
+	}
+	err := p.save()
+	if err == errConflict { // Someone else saved first -- Show both versions
+		current, _ := db.Get(pg.Name)
+		status := http.StatusConflict
+		if ifMatch {
+			status = http.StatusPreconditionFailed
+		}
+		writeConflict(w, status, pg.Name, current, string(p.Body))
+		return
+	}
+	check("Save Failed", err)
+	if np, ok := db.Get(pg.Name); ok {
+		w.Header().Set("ETag", etag(np))
 	}
-	p.save()
 	http.Redirect(w, r, "/view/"+name, http.StatusFound) // Redirect to /view/name
 }
 
@@ -269,29 +354,30 @@ func editHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "<h1>Edit Error: %s</h1>", "Blank Name")
 		return
 	}
-	p, ok := findName(xMem, string(name))
+	p, ok := findName(db, string(name))
 	if !ok { // Find Name
 		// If no name -
 		//Create name with empty body
-		np = Page{Index: len(xMem), Name: name, Body: []byte("")}
-		xMem = append(xMem, np)         // Append the in-memory database
-		data, err := json.Marshal(xMem) // Marshal xMem ==> Data set
-		check("Marshalling Failed", err)
-		writeData(data)                      // Write Data Set to disk
-		p, ok = findName(xMem, string(name)) // Find newly created name!
+		np = Page{Name: name, Body: []byte("")}
+		err := np.save() // Append the database -- Revision 1
+		check("Save Failed", err)
+		p, ok = findName(db, string(name)) // Find newly created name!
 		if !ok {
 			fmt.Println("Update Failure")
 			// Notify of failure
 			return
 		}
 	}
+	w.Header().Set("ETag", etag(p))
 	fmt.Fprintf(w, "<h1>Editing %s</h1>"+
-		// Build Form and send to client
+		// Build Form and send to client -- version detects a save in between
 		"<form action=\"/save/%s\" method=\"POST\">"+
 		"<textarea name=\"body\" rows=\"20\" cols=\"80\">%s</textarea><br>"+
+		"<input type=\"hidden\" name=\"version\" value=\"%d\">"+
+		"Expires (24h or 2006-01-02T15:04:05Z, blank for never): <input type=\"text\" name=\"expires\" value=\"%s\"><br>"+
 		"<input type=\"submit\" value=\"Save\">"+
 		"</form>",
-		p.Name, p.Name, p.Body)
+		p.Name, p.Name, p.Body, p.Version, formatExpires(p))
 }
 
 //
@@ -300,45 +386,25 @@ func editHandler(w http.ResponseWriter, r *http.Request) {
 //     Delete/Name
 //
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
-	var zMem []Page // Empty Database
 	name := r.URL.Path[len("/delete/"):]
 	if name == "ALL" {
-		// Process ALL
-		data, err := json.Marshal(zMem)
-		// Marshal empty Database
-		check("Marshalling Failed", err)
-		writeData(data)
-		// Write Data Set to disk
-		err = json.Unmarshal(data, &xMem) //Reload In-Memory Copy
-		check("Unmarshal Failed", err)
-		http.Redirect(w, r, "/view/", http.StatusFound)
-		// Redirect to /view
+		// Process ALL -- Only once confirmed (see deleteall.go)
+		deleteAllHandler(w, r)
+		return
 	}
-	p, ok := findExactName(xMem, string(name))
+	p, ok := findExactName(db, string(name))
 	// Not ALL - Find Name
-	if !ok && name != "ALL" {
+	var err error
+	if ok {
+		err = trashPage(db, p.Name, now())
+	}
+	if !ok || err == errNotFound {
 		// Report Failure
 		fmt.Fprintf(w, "<h1>Delete: '%s' %s</h1>", name, "not found!")
 		return
-	} else {
-		// Deletion has to be done this way to insure that internal index updated!
-		i := 0
-		for j, v := range xMem {
-			// Walk old Database and Create new Database
-			if j != p.Index {
-				zMem = append(zMem, Page{Index: i, Name: v.Name, Body: v.Body})
-				i++
-			}
-		}
-		data, err := json.Marshal(zMem)
-		// Marshal new Database
-		check("Marshalling Failed", err)
-		writeData(data)
-		// Write to disk
-		err = json.Unmarshal(data, &xMem)
-		//Reload In-Memory Copy
-		check("Unmarshal Failed", err)
-		http.Redirect(w, r, "/view/", http.StatusFound)
-		// Redirect to /view
 	}
+	check("Delete Failed", err)
+	// Moved to the trash -- /restore/name brings it back (see trash.go)
+	http.Redirect(w, r, "/view/", http.StatusFound)
+	// Redirect to /view
 }
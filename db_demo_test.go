@@ -4,12 +4,15 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 //
@@ -21,6 +24,50 @@ func testCheck(e error) {
 	}
 }
 
+//
+// Remove every Database file -- Next loadDatabase creates the Test Data
+//
+func removeDatabase() {
+	if db != nil {
+		db.Close()
+		db = nil
+	}
+	backups, _ := filepath.Glob(dataFile + ".v*.bak")
+	for _, f := range append(backups, dataFile, dataFile+".prev", dataFile+".tmp", dataFile+".corrupt", dataFile+".quarantine", dataFile+".rejected", "Data.log", "Data.log.orphan", pagesFile, pagesFile+".tmp", pagesFile+".idx", pagesFile+".idx.tmp", sqliteFile, sqliteFile+"-wal", sqliteFile+"-shm") {
+		os.Remove(f)
+	}
+	os.RemoveAll(pagesDir)
+	os.RemoveAll(pagesDir + ".tmp")
+}
+
+//
+// Replace the Database with an in-memory Storage holding the 'Data Set'
+//
+func testDatabase(data []byte) {
+	var pages []Page
+	err := json.Unmarshal(data, &pages)
+	testCheck(err)
+	if db != nil {
+		db.Close()
+	}
+	db = newMemStorage(pages)
+}
+
+//
+// Pages without what the database fills in -- IDs, Versions and revisions
+// are random or timed, the 'Data Set' constants have none
+//
+func pageContents(pages []Page) []Page {
+	for i := range pages {
+		pages[i].ID = ""
+		pages[i].Version = 0
+		pages[i].Rev = 0
+		pages[i].Saved = time.Time{}
+		pages[i].History = nil
+	}
+	return pages
+}
+
 //
 // Database 'Data Set' Constants.
 //   Name Code:  The first letter of each name, in order, followed by "_db".
@@ -43,14 +90,19 @@ const null_db = "null"
 // Test Database Loader
 //
 func TestLoadDatabase(t *testing.T) {
-	err := os.Remove("Data.db") // Remove Current Database
-	if err != nil {
-		fmt.Println("Database Not present - Creating")
-	}
+	removeDatabase() // Remove Current Database
 
 	loadDatabase() // Load Database
 
-	data, err := json.Marshal(xMem) // Marshall Database
+	ids := map[string]bool{}
+	for _, p := range db.List() { // Every Page has its own stable ID
+		if len(p.ID) != 26 || ids[p.ID] {
+			t.Error("Bad or duplicate ID: ", p)
+		}
+		ids[p.ID] = true
+	}
+
+	data, err := json.Marshal(pageContents(db.List())) // Marshall Database
 	testCheck(err)
 
 	if !reflect.DeepEqual(data, []byte(cajmj_db)) {
@@ -58,6 +110,40 @@ func TestLoadDatabase(t *testing.T) {
 	}
 }
 
+//
+// Test Database Loader -- Corrupt Data.db falls back to the previous generation
+//
+func TestLoadCorruptDatabase(t *testing.T) {
+	removeDatabase()
+	loadDatabase() // Generation 1: Test Data
+	want := db.List()
+	for _, p := range want {
+		testCheck(db.Delete(p.Name))
+	}
+	testCheck(db.(*fileStorage).checkpoint()) // Generation 2: Empty Database
+
+	err := ioutil.WriteFile(dataFile, []byte(cajmj_db[:40]), 0644) // Torn write
+	testCheck(err)
+	loadDatabase()
+	if !reflect.DeepEqual(db.List(), want) {
+		t.Error("\nExpected = ", want, "\nReturned = ", db.List())
+	}
+	if _, err := os.Stat(dataFile + ".corrupt"); err != nil {
+		t.Error("Damaged Data.db not kept: ", err)
+	}
+
+	// Both generations damaged -- Refuse to start, never reseed
+	testCheck(ioutil.WriteFile(dataFile, []byte("[{"), 0644))
+	testCheck(ioutil.WriteFile(dataFile+".prev", []byte("[{"), 0644))
+	defer func() {
+		if recover() == nil {
+			t.Error("loadDatabase accepted a corrupt database")
+		}
+		removeDatabase()
+	}()
+	loadDatabase()
+}
+
 //
 //  Test "viewHandler" Function
 //
@@ -152,8 +238,7 @@ func TestViewHandler(t *testing.T) {
 
 	for i, c := range cases {
 		// Create Desired Database
-		err = json.Unmarshal(c.initial_DB, &xMem) //Reload In-Memory Copy
-		testCheck(err)
+		testDatabase(c.initial_DB)
 
 		viewHandler(c.w, c.r)
 
@@ -173,6 +258,46 @@ func TestViewHandler(t *testing.T) {
 	}
 }
 
+type listCounter struct { // Storage that counts the listings asked of it
+	Storage
+	lists int
+}
+
+func (s *listCounter) List() []Page {
+	s.lists++
+	return s.Storage.List()
+}
+
+//
+// Test what viewHandler lists -- Only /view/ lists the Database; a named View
+// only asks whether it is empty when nothing matched
+//
+func TestViewListing(t *testing.T) {
+	cases := []struct {
+		db    string
+		url   string
+		want  string
+		lists int
+	}{
+		{cajmj_db, "/view/", "Record  4 :  Jacky", 1},
+		{cajmj_db, "/view/Charles", "<h1>View: Charles</h1>", 0},
+		{cajmj_db, "/view/Jac", "<h1>View: Name Matches > 1!</h1>", 0},
+		{cajmj_db, "/view/Henry", "<h1>View: Name not found!</h1>", 1},
+		{null_db, "/view/Henry", "<h1>View: Empty Database</h1>", 1},
+		{null_db, "/view/", "<h1>View: Empty Database</h1>", 1},
+	}
+	for _, c := range cases {
+		testDatabase([]byte(c.db))
+		counter := &listCounter{Storage: db}
+		db = counter
+		got := testRequest(viewHandler, "GET", c.url, "").Body.String()
+		if !strings.Contains(got, c.want) || counter.lists != c.lists {
+			t.Errorf("%s: %q, %d listings; Expected %q, %d", c.url, got, counter.lists, c.want, c.lists)
+		}
+		db = counter.Storage
+	}
+}
+
 //
 //  Test deleteHandler" Function
 //
@@ -183,6 +308,11 @@ func TestDeleteHandler(t *testing.T) {
 		t.Fatal("Delete NewRequest error: ", err)
 	}
 
+	dryRequest, err := http.NewRequest("GET", "/delete/ALL?dry-run=1", nil)
+	if err != nil {
+		t.Fatal("Delete NewRequest error: ", err)
+	}
+
 	annRequest, err := http.NewRequest("GET", "/delete/Ann", nil)
 	if err != nil {
 		t.Fatal("Delete NewRequest error: ", err)
@@ -214,18 +344,20 @@ func TestDeleteHandler(t *testing.T) {
 		{
 			w:                    httptest.NewRecorder(),
 			r:                    allRequest,
-			expectedResponseCode: http.StatusFound,
-			expectedResponseBody: []byte("<a href=\"/view/\">Found</a>.\n\n"),
+			expectedResponseCode: http.StatusOK,
+			expectedResponseBody: []byte("<h1>Delete ALL: Empty Database</h1>"),
 			initial_DB:           []byte(null_db),
 			returnedDB:           []byte(null_db),
 		},
 		{
 			w:                    httptest.NewRecorder(),
-			r:                    allRequest,
-			expectedResponseCode: http.StatusFound,
-			expectedResponseBody: []byte("<a href=\"/view/\">Found</a>.\n\n"),
-			initial_DB:           []byte(cajmj_db),
-			returnedDB:           []byte(null_db),
+			r:                    dryRequest,
+			expectedResponseCode: http.StatusOK,
+			expectedResponseBody: []byte("<h1>Delete ALL (dry run): 5 records would be moved to the trash</h1>" +
+				"<textarea nameM=\"body\" rows=\"20\" cols=\"80\">Record  0 :  Charles\nRecord  1 :  Ann\n" +
+				"Record  2 :  Jack\nRecord  3 :  Mike\nRecord  4 :  Jacky\n</textarea><br>"),
+			initial_DB: []byte(cajmj_db),
+			returnedDB: []byte(cajmj_db),
 		},
 		{
 			w:                    httptest.NewRecorder(),
@@ -264,16 +396,17 @@ func TestDeleteHandler(t *testing.T) {
 	var rMem []Page
 	for _, c := range cases {
 		// Create Desired Database
-		err = json.Unmarshal(c.initial_DB, &xMem) //Reload In-Memory Copy
-		testCheck(err)
+		testDatabase(c.initial_DB)
 
 		deleteHandler(c.w, c.r)
+		_, err = purgeTrash(db, now(), 0) // Empty the trash -- Deleted Pages are gone for good
+		testCheck(err)
 
 		// Compare to returned Database
 		err = json.Unmarshal(c.returnedDB, &rMem) //Reload In-Memory Copy
 		testCheck(err)
-		if !reflect.DeepEqual(xMem, rMem) {
-			t.Error("\nExpected Data.db        = ", xMem, "\nReceived the following  = ", rMem)
+		if !reflect.DeepEqual(pageContents(db.List()), rMem) {
+			t.Error("\nExpected Data.db        = ", db.List(), "\nReceived the following  = ", rMem)
 		}
 
 		if c.expectedResponseCode != c.w.Code {
@@ -339,7 +472,7 @@ func TestEditHandler(t *testing.T) {
 			w:                    httptest.NewRecorder(),
 			r:                    henryRequest,
 			expectedResponseCode: http.StatusOK,
-			expectedResponseBody: []byte("<h1>Editing Henry</h1><form action=\"/save/Henry\" method=\"POST\"><textarea name=\"body\" rows=\"20\" cols=\"80\"></textarea><br><input type=\"submit\" value=\"Save\"></form>"),
+			expectedResponseBody: []byte("<h1>Editing Henry</h1><form action=\"/save/Henry\" method=\"POST\"><textarea name=\"body\" rows=\"20\" cols=\"80\"></textarea><br><input type=\"hidden\" name=\"version\" value=\"1\">Expires (24h or 2006-01-02T15:04:05Z, blank for never): <input type=\"text\" name=\"expires\" value=\"\"><br><input type=\"submit\" value=\"Save\"></form>"),
 			initial_DB:           []byte(cjmj_db),
 			returnedDB:           []byte(cjmjh_db),
 		},
@@ -347,7 +480,7 @@ func TestEditHandler(t *testing.T) {
 			w:                    httptest.NewRecorder(),
 			r:                    jackRequest,
 			expectedResponseCode: http.StatusOK,
-			expectedResponseBody: []byte("<h1>Editing Jack</h1><form action=\"/save/Jack\" method=\"POST\"><textarea name=\"body\" rows=\"20\" cols=\"80\">Jack Data</textarea><br><input type=\"submit\" value=\"Save\"></form>"),
+			expectedResponseBody: []byte("<h1>Editing Jack</h1><form action=\"/save/Jack\" method=\"POST\"><textarea name=\"body\" rows=\"20\" cols=\"80\">Jack Data</textarea><br><input type=\"hidden\" name=\"version\" value=\"1\">Expires (24h or 2006-01-02T15:04:05Z, blank for never): <input type=\"text\" name=\"expires\" value=\"\"><br><input type=\"submit\" value=\"Save\"></form>"),
 			initial_DB:           []byte(cjmj_db),
 			returnedDB:           []byte(cjmj_db),
 		},
@@ -356,15 +489,14 @@ func TestEditHandler(t *testing.T) {
 	var rMem []Page
 	for _, c := range cases {
 		// Create Desired Database
-		err = json.Unmarshal(c.initial_DB, &xMem) //Reload In-Memory Copy
-		testCheck(err)
+		testDatabase(c.initial_DB)
 		editHandler(c.w, c.r)
 
 		// Compare to returned Database
 		err = json.Unmarshal(c.returnedDB, &rMem) //Reload In-Memory Copy
 		testCheck(err)
-		if !reflect.DeepEqual(xMem, rMem) {
-			t.Error("Expected Data.db   = ", xMem)
+		if !reflect.DeepEqual(pageContents(db.List()), rMem) {
+			t.Error("Expected Data.db   = ", db.List())
 			t.Error("Got the following  = ", rMem)
 		}
 
@@ -433,15 +565,14 @@ func TestSaveHandler(t *testing.T) {
 	var rMem []Page
 	for _, c := range cases[2:3] {
 		// Create Desired Database
-		err = json.Unmarshal(c.initial_DB, &xMem) //Reload In-Memory Copy
-		testCheck(err)
+		testDatabase(c.initial_DB)
 		saveHandler(c.w, c.r)
 
 		// Compare to returned Database
 		err = json.Unmarshal(c.returnedDB, &rMem) //Reload In-Memory Copy
 		testCheck(err)
-		if !reflect.DeepEqual(xMem, rMem) {
-			t.Error("\nExpected Data.db   = ", xMem, "\nReceived the following  = ", rMem)
+		if !reflect.DeepEqual(pageContents(db.List()), rMem) {
+			t.Error("\nExpected Data.db   = ", db.List(), "\nReceived the following  = ", rMem)
 		}
 
 		if c.expectedResponseCode != c.w.Code {
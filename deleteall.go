@@ -0,0 +1,172 @@
+// deleteall - Confirmation and Dry Run for /delete/ALL.
+// GET /delete/ALL changes nothing: it says how many records would go and
+// shows a form that POSTs back with a one-time confirmation token.
+// ?dry-run=1 lists the Names instead. Only a POST with a good token
+// deletes, and it saves a snapshot (see admin.go) before anything goes.
+// The delete itself is one Batch, so it lands in full or not at all.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const confirmTTL = 10 * time.Minute // How long a confirmation token is good for
+
+type confirmation struct { // What a token was issued for
+	count   int       // Records shown on the interstitial
+	expires time.Time // Refused from then on
+}
+
+var confirmMu sync.Mutex                      // Guards confirmTokens
+var confirmTokens = map[string]confirmation{} // Token ==> What it confirms
+
+//
+// New Confirmation Token -- For deleting count records, good for confirmTTL
+//
+func newConfirmToken(count int, t time.Time) string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	check("Token Failed", err)
+	token := hex.EncodeToString(b)
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+	for k, c := range confirmTokens {
+		if !t.Before(c.expires) {
+			delete(confirmTokens, k) // Never used
+		}
+	}
+	confirmTokens[token] = confirmation{count: count, expires: t.Add(confirmTTL)}
+	return token
+}
+
+//
+// Use a Confirmation Token -- Good once, and only before it expires
+//
+func useConfirmToken(token string, t time.Time) (confirmation, bool) {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+	c, ok := confirmTokens[token]
+	delete(confirmTokens, token)
+	return c, ok && t.Before(c.expires)
+}
+
+//
+// Live Pages -- The records /view/ lists
+//
+func livePages(s Storage, t time.Time) []Page {
+	var pages []Page
+	for _, p := range listPages(s) {
+		if live(p, t) {
+			pages = append(pages, p)
+		}
+	}
+	return pages
+}
+
+//
+// Snapshot of pages before Delete ALL -- Into -snapshot-dir, or beside Data.db without one
+//
+func saveDeleteSnapshot(pages []Page, t time.Time) (string, error) {
+	dir := *snapshotDir
+	if len(dir) <= 0 {
+		dir = "."
+	}
+	data, err := encodeSnapshot(pages, *dataEncoding)
+	if err != nil {
+		return "", err
+	}
+	return saveSnapshot(dir, data, t)
+}
+
+//
+// Delete ALL as one Batch -- A trash of every live Page, stamped t
+//
+// Each names the Version listed, so a save since refuses the whole Batch
+// with errConflict. No Body goes into the Batch.
+//
+func trashAllOps(pages []Page, t time.Time) []Op {
+	var ops []Op
+	for _, p := range pages {
+		if live(p, t) {
+			ops = append(ops, Op{Op: "trash", Name: p.Name, Version: p.Version, Deleted: t})
+		}
+	}
+	return ops
+}
+
+//
+// Delete ALL Handler --
+//
+// localhost:8080/delete/ALL            -- Asks first: how many, and a token to confirm
+// localhost:8080/delete/ALL?dry-run=1  -- Lists what would be deleted
+// POST localhost:8080/delete/ALL       -- token=... Snapshot, then every record to the trash
+//
+func deleteAllHandler(w http.ResponseWriter, r *http.Request) {
+	t := now()
+	pages := livePages(db, t)
+	if len(r.FormValue("dry-run")) > 0 {
+		var body string
+		for i, p := range pages {
+			body += fmt.Sprintln("Record ", i, ": ", p.Name) // Numbered as /view/ does
+		}
+		fmt.Fprintf(w, "<h1>Delete ALL (dry run): %d records would be moved to the trash</h1>"+
+			"<textarea nameM=\"body\" rows=\"20\" cols=\"80\">%s</textarea><br>", len(pages), body)
+		return
+	}
+	if r.Method != "POST" {
+		writeDeleteConfirm(w, pages, t)
+		return
+	}
+	c, ok := useConfirmToken(r.FormValue("token"), t)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "<h1>Delete ALL: %s</h1>", "Confirmation token missing or expired!")
+		return
+	}
+	all := db.List() // Bodies included -- For the snapshot
+	ops := trashAllOps(all, t)
+	if c.count != len(ops) { // Saved or deleted since -- Ask again
+		w.WriteHeader(http.StatusConflict)
+		writeDeleteConfirm(w, pages, t)
+		return
+	}
+	file, err := saveDeleteSnapshot(all, t)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "<h1>Delete ALL: Snapshot Failed, nothing deleted: %s</h1>", err)
+		return
+	}
+	fmt.Println("Saved", file, "before Delete ALL of", len(ops), "records")
+	err = opError(db.Apply(ops))
+	if err == errConflict { // Saved since the List -- Nothing deleted, ask again
+		w.WriteHeader(http.StatusConflict)
+		writeDeleteConfirm(w, livePages(db, t), t)
+		return
+	}
+	check("Delete Failed", err)
+	// Empty Database
+	http.Redirect(w, r, "/view/", http.StatusFound)
+	// Redirect to /view
+}
+
+//
+// Delete ALL interstitial -- The count and a form that confirms it
+//
+func writeDeleteConfirm(w http.ResponseWriter, pages []Page, t time.Time) {
+	if len(pages) <= 0 {
+		fmt.Fprintf(w, "<h1>Delete ALL: %s</h1>", "Empty Database")
+		return
+	}
+	fmt.Fprintf(w, "<h1>Delete ALL: %d records will be moved to the trash</h1>"+
+		"<form action=\"/delete/ALL\" method=\"POST\">"+
+		"<input type=\"hidden\" name=\"token\" value=\"%s\">"+
+		"<input type=\"submit\" value=\"Delete ALL\">"+
+		"</form>"+
+		"A snapshot is saved first. <a href=\"/delete/ALL?dry-run=1\">List them</a>",
+		len(pages), newConfirmToken(len(pages), t))
+}
@@ -0,0 +1,166 @@
+// deleteall_test - Test Suite for the db_demo Delete ALL confirmation.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var tokenPattern = regexp.MustCompile(`name="token" value="([0-9a-f]+)"`)
+
+//
+// Token on a Delete ALL interstitial -- Fails the test without one
+//
+func confirmToken(t *testing.T, w *httptest.ResponseRecorder) string {
+	m := tokenPattern.FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatalf("No confirmation token in %d %q", w.Code, w.Body.String())
+	}
+	return m[1]
+}
+
+//
+// Delete ALL as a browser does -- GET the interstitial, POST its token
+//
+func confirmDeleteAll(t *testing.T) *httptest.ResponseRecorder {
+	token := confirmToken(t, testRequest(deleteHandler, "GET", "/delete/ALL", ""))
+	return testRequest(deleteHandler, "POST", "/delete/ALL", "token="+token)
+}
+
+//
+// Test Delete ALL -- Nothing goes without a good token; a snapshot is saved first
+//
+func TestDeleteAllConfirm(t *testing.T) {
+	defer func(dir string) { *snapshotDir = dir }(*snapshotDir)
+	*snapshotDir = t.TempDir()
+	testDatabase([]byte(cajmj_db))
+	before := db.List()
+
+	w := testRequest(deleteHandler, "GET", "/delete/ALL", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "5 records will be moved to the trash") {
+		t.Errorf("Interstitial = %d %q", w.Code, w.Body.String())
+	}
+	token := confirmToken(t, w)
+	cases := []struct {
+		method string
+		body   string
+		want   int
+	}{
+		{"POST", "", http.StatusForbidden},
+		{"POST", "token=0123abcd", http.StatusForbidden},
+		{"POST", "token=" + token + "&dry-run=1", http.StatusOK},
+		{"GET", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		if w := testRequest(deleteHandler, c.method, "/delete/ALL", c.body); w.Code != c.want {
+			t.Errorf("%s %q = %d, Expected %d", c.method, c.body, w.Code, c.want)
+		}
+	}
+	if len(livePages(db, now())) != 5 {
+		t.Fatal("Deleted without a confirmation: ", db.List())
+	}
+
+	if w := testRequest(deleteHandler, "POST", "/delete/ALL", "token="+token); w.Code != http.StatusFound {
+		t.Errorf("Confirmed = %d %q", w.Code, w.Body.String())
+	}
+	if pages := livePages(db, now()); len(pages) != 0 {
+		t.Error("Left after Delete ALL: ", pages)
+	}
+	files, err := filepath.Glob(filepath.Join(*snapshotDir, "Data-*.db"))
+	testCheck(err)
+	if len(files) != 1 {
+		t.Fatal("Snapshots saved: ", files)
+	}
+	data, err := ioutil.ReadFile(files[0])
+	testCheck(err)
+	saved, _, err := decodeSnapshot(data)
+	testCheck(err)
+	if len(livePages(newMemStorage(saved), now())) != len(before) {
+		t.Error("\nSnapshot = ", saved, "\nExpected = ", before)
+	}
+
+	if w := testRequest(deleteHandler, "POST", "/delete/ALL", "token="+token); w.Code != http.StatusForbidden {
+		t.Errorf("Token used twice = %d", w.Code)
+	}
+}
+
+//
+// Test a stale confirmation -- Asked again when the count changed or the token expired
+//
+func TestDeleteAllStale(t *testing.T) {
+	defer func(dir string) { *snapshotDir = dir }(*snapshotDir)
+	*snapshotDir = t.TempDir()
+	testDatabase([]byte(cajmj_db))
+
+	token := confirmToken(t, testRequest(deleteHandler, "GET", "/delete/ALL", ""))
+	testRequest(deleteHandler, "GET", "/delete/Ann", "")
+	w := testRequest(deleteHandler, "POST", "/delete/ALL", "token="+token)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "4 records will be moved") {
+		t.Errorf("Stale count = %d %q", w.Code, w.Body.String())
+	}
+	if len(livePages(db, now())) != 4 {
+		t.Error("Deleted on a stale count: ", db.List())
+	}
+
+	token = confirmToken(t, w) // The new interstitial's
+	if _, ok := useConfirmToken(token, now().Add(confirmTTL)); ok {
+		t.Error("Expired token accepted")
+	}
+	if w := testRequest(deleteHandler, "POST", "/delete/ALL", "token="+token); w.Code != http.StatusForbidden {
+		t.Errorf("Token used after it expired = %d", w.Code)
+	}
+	if _, ok := useConfirmToken(newConfirmToken(1, now()), now().Add(time.Minute)); !ok {
+		t.Error("Fresh token refused")
+	}
+}
+
+//
+// Test Delete ALL as one Batch -- One Log record; a save in between stops all of it
+//
+func TestDeleteAllBatch(t *testing.T) {
+	defer func(dir string) { *snapshotDir = dir }(*snapshotDir)
+	*snapshotDir = t.TempDir()
+	freshDatabase()
+	defer removeDatabase()
+	testCheck(db.Put(Page{Name: "Henry", Body: []byte("Henry Data")}))
+	before, err := ioutil.ReadFile("Data.log")
+	testCheck(err)
+
+	if w := confirmDeleteAll(t); w.Code != http.StatusFound {
+		t.Errorf("Confirmed = %d %q", w.Code, w.Body.String())
+	}
+	after, err := ioutil.ReadFile("Data.log")
+	testCheck(err)
+	if n := bytes.Count(after, []byte("\n")) - bytes.Count(before, []byte("\n")); n != 1 {
+		t.Errorf("Delete ALL wrote %d Log records, Expected one", n)
+	}
+	rec, err := decodeRecord(bytes.TrimSuffix(after[len(before):], []byte("\n")))
+	testCheck(err)
+	for _, op := range rec.Batch {
+		if op.Op != "trash" || len(op.Page.Name) > 0 {
+			t.Errorf("Delete ALL logged %s %q with its Page, Expected only a trash", op.Op, op.Page.Name)
+		}
+	}
+	loadDatabase()
+	if pages := livePages(db, now()); len(pages) != 0 {
+		t.Error("Left after Delete ALL and a restart: ", pages)
+	}
+
+	testCheck(restorePage(db, "Ann"))
+	testCheck(restorePage(db, "Mike"))
+	ops := trashAllOps(db.List(), now())
+	testCheck(db.Put(Page{Name: "Mike", Body: []byte("Mike Saved")})) // In between
+	if err := db.Apply(ops); opError(err) != errConflict {
+		t.Errorf("Stale Delete ALL = %v; Expected %v", err, errConflict)
+	}
+	if pages := livePages(db, now()); len(pages) != 2 {
+		t.Error("Stale Delete ALL changed the database: ", pages)
+	}
+}
@@ -0,0 +1,577 @@
+// dir - Directory Storage: One File per Page.
+// Every Page is kept in Data.dir as a file of its own, named after the Page
+// (see pageFileName), so pages can be read, grepped and versioned with
+// ordinary tools. A file is one JSON line of Page metadata (checksum
+// included) followed by the Body exactly as it was saved. A save writes
+// only the file of its Page; a Batch or a Restore that changes several
+// files lists them in Data.dir/journal first, so after a crash it is
+// completed at the next start. As for the File Storage, all Pages are
+// also held in memory.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const pagesDir = "Data.dir" // Directory Storage: One file per Page
+
+const pageExt = ".page" // Ending of every Page file
+
+const journalName = "journal" // Change in progress, inside the directory
+
+const maxFileName = 200 // Longer file names are cut and end in a hash of the Name
+
+type pageHeader struct { // First line of a Page file
+	Seq  int64 // Display order -- Kept by updates and renames; deletes leave gaps
+	Page Page  // The Page without its Body, Sum set
+}
+
+type dirJournal struct { // Data.dir/journal -- Files a change writes and removes, as one
+	Clear  bool              `json:",omitempty"` // Remove every other Page file (Restore)
+	Write  map[string][]byte // File name ==> Contents
+	Remove []string          `json:",omitempty"` // File names
+}
+
+type dirStorage struct { // Directory Storage
+	*memStorage                  // In-memory copy of the Database
+	dir         string           // Page files: Data.dir
+	journal     string           // Change in progress: Data.dir/journal
+	writeMu     sync.Mutex       // Serializes changes
+	seqs        map[string]int64 // ID ==> Seq of its file (writeMu)
+	nextSeq     int64            // Seq of the next new Page (writeMu)
+	broken      error            // A journal that could not be completed -- Refuses later changes (writeMu)
+	dirtyMu     sync.Mutex       // Guards dirty
+	dirty       map[string]bool  // Files written but not flushed yet (-fsync interval)
+	syncs       *syncer          // Flushes the files as -fsync asks (fsync.go)
+}
+
+//
+// Open Directory Storage -- Every Page file, after completing any journal
+//
+// A new Data.dir starts from Data.db (with Data.log) when there is one,
+// otherwise from the test data.
+//
+func openDirStorage(dir string) (*dirStorage, error) {
+	s := &dirStorage{
+		memStorage: newMemStorage(nil),
+		dir:        dir,
+		journal:    filepath.Join(dir, journalName),
+		seqs:       map[string]int64{},
+		dirty:      map[string]bool{},
+	}
+	s.syncs = newSyncer(*fsyncPolicy, s.flush)
+	var err error
+	if _, statErr := os.Stat(dir); os.IsNotExist(statErr) {
+		err = s.seed()
+	} else {
+		err = s.load()
+	}
+	if err == nil {
+		err = s.syncs.start()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//
+// File name for a Page -- The same on every file system, for every Name
+//
+// Lower case letters, digits and '-' are kept; an upper case letter is
+// written as '_' and the letter in lower case (so "Ann" and "ann" differ
+// on file systems that ignore case); any other byte as %XX. Names too
+// long for a file name are cut and end in '~' and a hash of the Name.
+//
+func pageFileName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-':
+			b.WriteByte(c)
+		case 'A' <= c && c <= 'Z':
+			b.WriteByte('_')
+			b.WriteByte(c - 'A' + 'a')
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	file := b.String()
+	if len(file) > maxFileName {
+		sum := sha256.Sum256([]byte(name))
+		file = fmt.Sprintf("%s~%x", file[:maxFileName-17], sum[:8])
+	}
+	return file + pageExt
+}
+
+//
+// Encode a Page file -- Metadata line, then the Body as is; sealed when a key is set
+//
+func encodePageFile(seq int64, p Page) ([]byte, error) {
+	p.Sum = pageSum(p)
+	body := p.Body
+	p.Body = nil
+	p.Index = 0 // Display order comes from Seq
+	head, err := json.Marshal(pageHeader{Seq: seq, Page: p})
+	if err != nil {
+		return nil, err
+	}
+	return sealFile(append(append(head, '\n'), body...))
+}
+
+//
+// Decode a Page file -- Its Seq and the Page, checksum verified and cleared
+//
+func decodePageFile(data []byte, what string) (int64, Page, error) {
+	data, err := unsealFile(data, what)
+	if err != nil {
+		return 0, Page{}, err
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return 0, Page{}, fmt.Errorf("%s: no metadata line", what)
+	}
+	var h pageHeader
+	if err := json.Unmarshal(data[:i], &h); err != nil {
+		return 0, Page{}, fmt.Errorf("%s: %v", what, err)
+	}
+	p := h.Page
+	p.Body = data[i+1:]
+	if p.Sum != pageSum(p) {
+		return 0, Page{}, fmt.Errorf("%s: checksum mismatch", what)
+	}
+	p.Sum = 0
+	return h.Seq, p, nil
+}
+
+//
+// Write a file -- Beside it first, then renamed into place; flushed if asked
+//
+func writeFile(file string, data []byte, flush bool) error {
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && flush {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+//
+// Seed a new Data.dir -- From Data.db if there is one
+//
+// The files are written to Data.dir.tmp, which is renamed into place once
+// complete.
+//
+func (s *dirStorage) seed() error {
+	pages, err := importDataFile(s.dir)
+	if err != nil {
+		return err
+	}
+	s.reset(uniqueNames(pages)) // IDs for Pages from before stable IDs
+
+	tmp := s.dir + ".tmp"
+	os.RemoveAll(tmp) // Left over from a crash during an earlier seed
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return err
+	}
+	flush := s.syncs.policy != "none"
+	for i, p := range s.pages {
+		data, err := encodePageFile(int64(i), p)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(tmp, pageFileName(p.Name)), data, flush); err != nil {
+			return err
+		}
+		s.seqs[p.ID] = int64(i)
+	}
+	s.nextSeq = int64(len(s.pages))
+	if flush {
+		if err := syncDir(tmp); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, s.dir); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.dir))
+}
+
+//
+// Pages with a Name of their own -- The first Page wins, as in memory
+//
+// A Data.db with a duplicated Name (see fsck) is imported without the
+// Pages that were never reachable anyway.
+//
+func uniqueNames(pages []Page) []Page {
+	seen := map[string]bool{}
+	var unique []Page
+	for _, p := range pages {
+		if !seen[p.Name] {
+			seen[p.Name] = true
+			unique = append(unique, p)
+		}
+	}
+	return unique
+}
+
+//
+// Load every Page file -- After completing a journal left by a crash
+//
+func (s *dirStorage) load() error {
+	if data, err := ioutil.ReadFile(s.journal); err == nil {
+		fmt.Println("Completing the change in", s.journal)
+		var j dirJournal
+		if err := json.Unmarshal(data, &j); err != nil {
+			return fmt.Errorf("%s: %v", s.journal, err)
+		}
+		if err := s.finish(j); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	temps, _ := filepath.Glob(filepath.Join(s.dir, "*.tmp"))
+	for _, tmp := range temps {
+		os.Remove(tmp) // Left over from a crash during writeFile
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+pageExt))
+	if err != nil {
+		return err
+	}
+	seqs := make(map[string]int64, len(files)) // Name ==> Seq
+	pages := make([]Page, 0, len(files))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		seq, p, err := decodePageFile(data, file)
+		if err != nil {
+			return err
+		}
+		if pageFileName(p.Name) != filepath.Base(file) {
+			return fmt.Errorf("%s: holds page %q, which belongs in %s", file, p.Name, pageFileName(p.Name))
+		}
+		seqs[p.Name] = seq
+		pages = append(pages, p)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		if seqs[pages[i].Name] != seqs[pages[j].Name] {
+			return seqs[pages[i].Name] < seqs[pages[j].Name]
+		}
+		return pages[i].ID < pages[j].ID
+	})
+	s.reset(pages)
+	for _, p := range s.pages {
+		s.seqs[p.ID] = seqs[p.Name]
+		if seqs[p.Name] >= s.nextSeq {
+			s.nextSeq = seqs[p.Name] + 1
+		}
+	}
+	return nil
+}
+
+//
+// Flush the files written since the last flush, then the directory
+//
+func (s *dirStorage) flush() error {
+	s.dirtyMu.Lock()
+	dirty := s.dirty
+	s.dirty = map[string]bool{}
+	s.dirtyMu.Unlock()
+	for file := range dirty {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue // Removed since
+		}
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(s.dir)
+}
+
+//
+// Write one Page file -- Flushed now for -fsync always, later for interval
+//
+func (s *dirStorage) writePage(name string, data []byte) error {
+	file := filepath.Join(s.dir, name)
+	if err := writeFile(file, data, s.syncs.policy == "always"); err != nil {
+		return err
+	}
+	if s.syncs.policy == "interval" {
+		s.dirtyMu.Lock()
+		s.dirty[file] = true
+		s.dirtyMu.Unlock()
+	}
+	return nil
+}
+
+//
+// Carry out a journal -- Write and remove its files, then drop the journal
+//
+// Safe to repeat: a journal is only ever completed, never undone.
+//
+func (s *dirStorage) finish(j dirJournal) error {
+	for name, data := range j.Write {
+		if err := writeFile(filepath.Join(s.dir, name), data, s.syncs.policy != "none"); err != nil {
+			return err
+		}
+	}
+	remove := j.Remove
+	if j.Clear {
+		files, err := filepath.Glob(filepath.Join(s.dir, "*"+pageExt))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if _, ok := j.Write[filepath.Base(file)]; !ok {
+				remove = append(remove, filepath.Base(file))
+			}
+		}
+	}
+	for _, name := range remove {
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if s.syncs.policy != "none" {
+		if err := syncDir(s.dir); err != nil { // Every file in place before the journal goes
+			return err
+		}
+	}
+	if err := os.Remove(s.journal); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//
+// Write the files of a change -- Through the journal when there is more than one
+//
+// Once the journal is on disk the change counts as made: if it cannot be
+// completed now, the next start completes it and later changes are refused.
+//
+func (s *dirStorage) writeChange(j dirJournal) (committed bool, err error) {
+	if len(j.Write)+len(j.Remove) == 0 && !j.Clear {
+		return false, nil // Empty Batch
+	}
+	if len(j.Write)+len(j.Remove) == 1 && !j.Clear {
+		for name, data := range j.Write {
+			return false, s.writePage(name, data)
+		}
+		err := os.Remove(filepath.Join(s.dir, j.Remove[0]))
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return false, nil
+	}
+	data, err := json.Marshal(j)
+	if err != nil {
+		return false, err
+	}
+	flush := s.syncs.policy != "none"
+	if err := writeFile(s.journal, data, flush); err != nil {
+		return false, err
+	}
+	if flush {
+		if err := syncDir(s.dir); err != nil {
+			return false, err
+		}
+	}
+	if err := s.finish(j); err != nil {
+		s.broken = fmt.Errorf("%s not completed - restart to finish it: %v", s.journal, err)
+		return true, s.broken
+	}
+	return true, nil
+}
+
+//
+// Commit a change -- Check it, write the files it changes, apply it in memory, flush it
+//
+func (s *dirStorage) commit(ops []Op) error {
+	seq, err := s.writeAndApply(ops)
+	if err != nil {
+		return err
+	}
+	return s.syncs.wait(seq) // Durable before the Client sees the Result
+}
+
+//
+// Write and apply a change (under writeMu) -- Returns the write to wait for
+//
+// The Pages the Operations touch are copied and the Operations applied to
+// the copies first; that gives the files to write and to remove.
+//
+func (s *dirStorage) writeAndApply(ops []Op) (int64, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.broken != nil {
+		return 0, s.broken
+	}
+	s.mu.RLock()
+	ops, err := s.checkBatch(ops, now()) // Reject before anything is written
+	var touched []Page
+	seen := map[string]bool{} // Names already in touched
+	if err == nil {
+		for _, op := range ops {
+			for _, name := range []string{op.Page.Name, op.Name, op.NewName} {
+				if i, ok := s.byName[name]; ok && !seen[name] {
+					seen[name] = true
+					touched = append(touched, s.pages[i])
+				}
+			}
+		}
+	}
+	s.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	after := newMemStorage(touched)
+	if err := after.applyLogged(ops); err != nil {
+		return 0, err
+	}
+	j := dirJournal{Write: map[string][]byte{}}
+	seqs := map[string]int64{} // ID ==> Seq of the Pages still there
+	next := s.nextSeq
+	for _, p := range after.pages {
+		seq, ok := s.seqs[p.ID]
+		if !ok {
+			seq = next // New Page -- In the order memStorage appends it
+			next++
+		}
+		data, err := encodePageFile(seq, p)
+		if err != nil {
+			return 0, err
+		}
+		j.Write[pageFileName(p.Name)] = data
+		seqs[p.ID] = seq
+	}
+	for _, p := range touched {
+		if _, ok := after.byName[p.Name]; !ok {
+			j.Remove = append(j.Remove, pageFileName(p.Name))
+		}
+	}
+
+	committed, err := s.writeChange(j)
+	if err != nil && !committed {
+		return 0, err
+	}
+	for _, p := range touched {
+		if _, ok := seqs[p.ID]; !ok {
+			delete(s.seqs, p.ID)
+		}
+	}
+	for id, seq := range seqs {
+		s.seqs[id] = seq
+	}
+	s.nextSeq = next
+	seq := s.syncs.wrote()
+	s.mu.Lock()
+	aerr := s.applyBatch(ops)
+	s.mu.Unlock()
+	if err == nil {
+		err = aerr
+	}
+	return seq, err
+}
+
+//
+// Put -- Write the file of the Page, then change the in-memory copy
+//
+func (s *dirStorage) Put(p Page) error {
+	return opError(s.commit([]Op{{Op: "put", Page: p}}))
+}
+
+//
+// Delete -- Remove the file of the Page, then change the in-memory copy
+//
+func (s *dirStorage) Delete(name string) error {
+	return opError(s.commit([]Op{{Op: "delete", Name: name}}))
+}
+
+//
+// Apply a Batch -- Checked in full, then every file it changes through the journal
+//
+func (s *dirStorage) Apply(ops []Op) error {
+	return s.commit(ops)
+}
+
+//
+// Restore -- Every Page file rewritten and the rest removed through the journal
+//
+// Every Page must have an ID.
+//
+func (s *dirStorage) Restore(pages []Page) error {
+	seq, err := s.restore(append([]Page(nil), pages...))
+	if err != nil {
+		return err
+	}
+	return s.syncs.wait(seq)
+}
+
+//
+// Restore under writeMu -- Returns the write to wait for
+//
+func (s *dirStorage) restore(pages []Page) (int64, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.broken != nil {
+		return 0, s.broken
+	}
+	j := dirJournal{Clear: true, Write: make(map[string][]byte, len(pages))}
+	seqs := make(map[string]int64, len(pages))
+	for i, p := range pages {
+		data, err := encodePageFile(int64(i), p)
+		if err != nil {
+			return 0, err
+		}
+		j.Write[pageFileName(p.Name)] = data
+		seqs[p.ID] = int64(i)
+	}
+	committed, err := s.writeChange(j)
+	if err != nil && !committed {
+		return 0, err
+	}
+	s.seqs, s.nextSeq = seqs, int64(len(pages))
+	s.reset(pages)
+	return s.syncs.wrote(), err
+}
+
+//
+// Close -- Flush what -fsync left
+//
+func (s *dirStorage) Close() error {
+	return s.syncs.stop()
+}
@@ -0,0 +1,171 @@
+// dir_test - Test Suite for the db_demo Directory Storage.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// Test Page file names -- Safe on every file system, one per Name
+//
+func TestPageFileName(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"ann", "ann.page"},
+		{"Ann", "_ann.page"},
+		{"Page 1", "_page%201.page"},
+		{"../etc/passwd", "%2E%2E%2Fetc%2Fpasswd.page"},
+		{"a_b~c%d", "a%5Fb%7Ec%25d.page"},
+		{"Zoë", "_zo%C3%AB.page"},
+		{"", ".page"},
+	}
+	for _, c := range cases {
+		if got := pageFileName(c.name); got != c.want {
+			t.Errorf("pageFileName(%q) = %q, Expected %q", c.name, got, c.want)
+		}
+	}
+	a, b := pageFileName(long+"a"), pageFileName(long+"b")
+	if a == b || len(a) > 255 || !strings.Contains(a, "~") {
+		t.Errorf("long names: %q, %q", a, b)
+	}
+}
+
+//
+// Test the Directory Storage -- One file per Page, a save touches only its own
+//
+func TestDirStorage(t *testing.T) {
+	removeDatabase()
+	defer removeDatabase()
+	s, err := openDirStorage(pagesDir)
+	testCheck(err)
+	files, _ := filepath.Glob(filepath.Join(pagesDir, "*"+pageExt))
+	if len(files) != 5 {
+		t.Errorf("%d Page files, Expected 5", len(files))
+	}
+
+	before := dirContents(t)
+	testCheck(s.Put(Page{Name: "Ann", Body: []byte("New Ann Data")}))
+	after := dirContents(t)
+	for name, data := range before {
+		if changed := !bytes.Equal(after[name], data); changed != (name == "_ann.page") {
+			t.Errorf("%s changed: %v", name, changed)
+		}
+	}
+	if !bytes.HasSuffix(after["_ann.page"], []byte("\nNew Ann Data")) {
+		t.Errorf("Body not stored as is: %q", after["_ann.page"])
+	}
+
+	testCheck(s.Delete("Mike"))
+	testCheck(s.Apply([]Op{
+		{Op: "put", Page: Page{Name: "Henry", Body: []byte("Henry Data")}},
+		{Op: "rename", Name: "Jack", NewName: "John"},
+	}))
+	want := []string{"Charles=Charles Data", "Ann=New Ann Data", "John=Jack Data", "Jacky=Jacky Data", "Henry=Henry Data"}
+	if got := namesAndBodies(s.List()); !reflect.DeepEqual(got, want) {
+		t.Errorf("\n\tExpected:\t%q\n\tGot:\t%q", want, got)
+	}
+	for _, name := range []string{"_mike.page", "_jack.page", journalName} {
+		if _, err := os.Stat(filepath.Join(pagesDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s still there: %v", name, err)
+		}
+	}
+	list := s.List()
+	testCheck(s.Close())
+
+	s, err = openDirStorage(pagesDir) // Same order, IDs and Versions
+	testCheck(err)
+	if !reflect.DeepEqual(s.List(), list) {
+		t.Errorf("\nReopened = %v\nExpected = %v", s.List(), list)
+	}
+	testCheck(s.Put(Page{Name: "Zed"}))
+	if p, _ := s.Get("Zed"); p.Index != 5 {
+		t.Errorf("New Page at %d, Expected the end", p.Index)
+	}
+	testCheck(s.Close())
+
+	testCheck(ioutil.WriteFile(filepath.Join(pagesDir, "_charles.page"), []byte("{}\nChanged"), 0644))
+	if _, err := openDirStorage(pagesDir); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("damaged file loaded: %v", err)
+	}
+}
+
+//
+// Contents of every file in Data.dir by name
+//
+func dirContents(t *testing.T) map[string][]byte {
+	files, err := ioutil.ReadDir(pagesDir)
+	testCheck(err)
+	contents := map[string][]byte{}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(pagesDir, f.Name()))
+		testCheck(err)
+		contents[f.Name()] = data
+	}
+	return contents
+}
+
+//
+// Test the journal -- A change cut short by a crash is completed at the next start
+//
+func TestDirJournal(t *testing.T) {
+	removeDatabase()
+	defer removeDatabase()
+	s, err := openDirStorage(pagesDir)
+	testCheck(err)
+	ann, _ := s.Get("Ann")
+	testCheck(s.Close())
+
+	ann.Body = []byte("Journal Data")
+	data, err := encodePageFile(1, ann)
+	testCheck(err)
+	j, err := json.Marshal(dirJournal{Write: map[string][]byte{"_ann.page": data}, Remove: []string{"_mike.page"}})
+	testCheck(err)
+	testCheck(ioutil.WriteFile(filepath.Join(pagesDir, journalName), j, 0644))
+	testCheck(ioutil.WriteFile(filepath.Join(pagesDir, "_jack.page.tmp"), []byte("torn"), 0644))
+
+	s, err = openDirStorage(pagesDir)
+	testCheck(err)
+	defer s.Close()
+	want := []string{"Charles=Charles Data", "Ann=Journal Data", "Jack=Jack Data", "Jacky=Jacky Data"}
+	if got := namesAndBodies(s.List()); !reflect.DeepEqual(got, want) {
+		t.Errorf("\n\tExpected:\t%q\n\tGot:\t%q", want, got)
+	}
+	for _, name := range []string{journalName, "_jack.page.tmp"} {
+		if _, err := os.Stat(filepath.Join(pagesDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", name, err)
+		}
+	}
+}
+
+//
+// Test the migration -- A new Data.dir starts from Data.db
+//
+func TestDirImport(t *testing.T) {
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+	removeDatabase()
+	defer removeDatabase()
+	*storageKind = "file"
+	loadDatabase()
+	testCheck(db.Put(Page{Name: "Henry", Body: []byte("Henry Data")}))
+	testCheck(db.Delete("Ann"))
+	want := db.List()
+
+	*storageKind = "dir"
+	loadDatabase()
+	if got := db.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("\nImported = %v\nExpected = %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(pagesDir, "_henry.page")); err != nil {
+		t.Error(err)
+	}
+}
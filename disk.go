@@ -0,0 +1,824 @@
+// disk - Disk Storage: Bodies stay on disk.
+// Every change is appended to Data.pages as one record per line, in the
+// same form as Data.log, and never folded into a Snapshot. Memory only
+// holds the Page metadata (Name, ID, Version, Expires ...) and where the
+// latest record of each Page is; Bodies and revisions are read back on
+// demand through an LRU cache of at most -cache-bytes. Data.pages.idx
+// saves that index, so a restart only reads the records added since.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var cacheBytes = flag.Int64("cache-bytes", 64<<20, "Disk storage: most bytes of Bodies cached in memory")
+
+const pagesFile = "Data.pages" // Disk Storage Records
+
+const compactMin = 1 << 20 // Data.pages is only compacted above this size ...
+const compactRatio = 2     // ... and when it is this many times the live records
+
+type recordRef struct { // Where the Body and revisions of a Page are on disk
+	Offset int64 // Start of the record in Data.pages
+	Length int   // Bytes in the record, without the newline
+	Op     int   // Operation of a batch record -- -1 for any other record
+}
+
+type historyLink struct { // Record logged without the revisions it kept (see history.go)
+	Ref    recordRef // The record
+	Prev   recordRef // Record of the Page it replaced -- Holds the kept revisions
+	Kept   int       // How many of its last revisions were kept
+	Logged int       // Revisions in the record itself
+}
+
+type diskIndex struct { // Data.pages.idx -- The in-memory index, saved
+	Size  int64         // Length of Data.pages it covers
+	Pages []Page        // Page metadata in Index order
+	Refs  []recordRef   // Record of each Page
+	Links []historyLink `json:",omitempty"` // Records the History of a Page is still read from
+}
+
+type metadataLister interface { // Storage that lists Pages without reading every Body
+	ListMetadata() []Page
+}
+
+type metadataSearcher interface { // Storage that finds Pages by Name without reading their Bodies
+	SearchMetadata(substr string) []Page
+}
+
+type diskStorage struct { // Disk Storage
+	*memStorage                           // Page metadata -- Bodies and revisions left out
+	file        string                    // Records: Data.pages
+	index       string                    // Saved index: Data.pages.idx
+	f           *os.File                  // Data.pages -- Read at offsets (s.mu), written at the end (writeMu)
+	writeMu     sync.Mutex                // Serializes changes
+	fileMu      sync.RWMutex              // Swapping f -- Held to fsync it
+	indexMu     sync.Mutex                // Serializes index saves
+	size        int64                     // End of the last complete record (writeMu)
+	indexed     int64                     // size when the index was last saved (indexMu)
+	refs        map[string]recordRef      // ID ==> Latest record of the Page (s.mu)
+	links       map[recordRef]historyLink // Record ==> Where its kept revisions are (s.mu)
+	cache       *lruCache                 // Bodies read recently
+	syncs       *syncer                   // Flushes Data.pages as -fsync asks (fsync.go)
+	done        chan bool                 // Stops the index saver
+}
+
+//
+// Open Disk Storage -- Saved index plus the records written after it
+//
+// A new Data.pages starts from Data.db (with Data.log) when there is one,
+// otherwise from the test data.
+//
+func openDiskStorage(file string, cacheLimit int64) (*diskStorage, error) {
+	s := &diskStorage{
+		memStorage: newMemStorage(nil),
+		file:       file,
+		index:      file + ".idx",
+		refs:       map[string]recordRef{},
+		links:      map[recordRef]historyLink{},
+		cache:      newLRUCache(cacheLimit),
+		done:       make(chan bool),
+	}
+	s.syncs = newSyncer(*fsyncPolicy, func() error {
+		s.fileMu.RLock()
+		defer s.fileMu.RUnlock()
+		return s.f.Sync()
+	})
+	_, statErr := os.Stat(file)
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.f = f
+	if os.IsNotExist(statErr) {
+		err = s.seed()
+	} else {
+		err = s.load()
+	}
+	if err == nil {
+		err = s.syncs.start()
+	}
+	if err != nil {
+		s.f.Close()
+		return nil, err
+	}
+	go s.indexSaver(time.Minute)
+	return s, nil
+}
+
+//
+// Page metadata -- What the Disk Storage keeps in memory
+//
+func metadata(p Page) Page {
+	p.Body = nil
+	p.History = nil
+	p.Sum = 0
+	p.Compressed = ""
+	return p
+}
+
+//
+// Seed a new Data.pages -- From Data.db if there is one
+//
+func (s *diskStorage) seed() error {
+	os.Remove(s.index) // Belongs to a Data.pages that is gone
+	pages, err := importDataFile(s.file)
+	if err != nil {
+		return err
+	}
+	recs := make([]logRecord, len(pages))
+	for i, p := range pages {
+		if len(p.ID) <= 0 {
+			p.ID = newID() // In the record, so a replay gives the same ID
+		}
+		recs[i] = logRecord{Op: "page", Page: p}
+	}
+	refs, err := s.write(recs)
+	if err != nil {
+		return err
+	}
+	if err := s.f.Sync(); err != nil { // One fsync for the whole import
+		return err
+	}
+	for i, rec := range recs {
+		if err := s.apply(rec, refs[i]); err != nil {
+			return err
+		}
+	}
+	return s.saveIndex()
+}
+
+//
+// Load the saved index, replay the records after it, compact if mostly garbage
+//
+func (s *diskStorage) load() error {
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	from := s.loadIndex(info.Size())
+	if err := s.replay(from); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	live := map[int64]int{} // Record offset ==> Length -- A batch record counts once
+	for _, ref := range s.refs {
+		for _, r := range s.chain(ref) {
+			live[r.Offset] = r.Length + 1
+		}
+	}
+	s.mu.RUnlock()
+	var liveBytes int64
+	for _, n := range live {
+		liveBytes += int64(n)
+	}
+	if s.size > compactMin && s.size > compactRatio*liveBytes {
+		return s.compact()
+	}
+	if s.size != from {
+		return s.saveIndex()
+	}
+	return nil
+}
+
+//
+// Load the saved index -- Returns how much of Data.pages it covers (0 if unusable)
+//
+func (s *diskStorage) loadIndex(fileSize int64) int64 {
+	data, err := ioutil.ReadFile(s.index)
+	if err == nil {
+		data, err = unsealFile(data, s.index)
+	}
+	if err != nil {
+		return 0
+	}
+	var idx diskIndex
+	if err := json.Unmarshal(data, &idx); err != nil || idx.Size > fileSize || len(idx.Refs) != len(idx.Pages) {
+		fmt.Println(s.index, "does not match", s.file, "- reading all records")
+		return 0
+	}
+	s.reset(idx.Pages)
+	s.mu.Lock()
+	for i, p := range idx.Pages {
+		s.refs[p.ID] = idx.Refs[i]
+	}
+	for _, l := range idx.Links {
+		s.links[l.Ref] = l
+	}
+	s.mu.Unlock()
+	s.indexMu.Lock()
+	s.indexed = idx.Size
+	s.indexMu.Unlock()
+	return idx.Size
+}
+
+//
+// Replay the records from offset from -- Bodies are read, checked and dropped
+//
+// A torn last record (crash mid-append, no trailing newline) is cut off.
+//
+func (s *diskStorage) replay(from int64) error {
+	if _, err := s.f.Seek(from, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.f)
+	off := from
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fmt.Println(s.file + ": dropping incomplete last record")
+				if err := s.f.Truncate(off); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rec, err := decodeRecord(line)
+		if err != nil {
+			return fmt.Errorf("%s: record at %d: %v", s.file, off, err)
+		}
+		ok := checkLogSum(&rec.Page)
+		for i := range rec.Batch {
+			ok = checkLogSum(&rec.Batch[i].Page) && ok
+		}
+		if !ok {
+			return fmt.Errorf("%s: record at %d: checksum mismatch", s.file, off)
+		}
+		if err := s.apply(rec, recordRef{Offset: off, Length: len(line) - 1, Op: -1}); err != nil {
+			return fmt.Errorf("%s: record at %d: %v", s.file, off, err)
+		}
+		off += int64(len(line))
+	}
+	s.size = off
+	return nil
+}
+
+//
+// Write records at the end of Data.pages -- Flushed by the caller
+//
+func (s *diskStorage) write(recs []logRecord) ([]recordRef, error) {
+	data, refs, err := encodeRecords(recs, s.size)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.f.WriteAt(data, s.size); err != nil {
+		return nil, err
+	}
+	s.size += int64(len(data))
+	return refs, nil
+}
+
+//
+// Encode records one per line -- Their refs as if written at offset base
+//
+func encodeRecords(recs []logRecord, base int64) ([]byte, []recordRef, error) {
+	var buf bytes.Buffer
+	refs := make([]recordRef, len(recs))
+	for i, rec := range recs {
+		line, err := marshalRecord(rec)
+		if err != nil {
+			return nil, nil, err
+		}
+		refs[i] = recordRef{Offset: base + int64(buf.Len()), Length: len(line), Op: -1}
+		buf.Write(append(line, '\n'))
+	}
+	return buf.Bytes(), refs, nil
+}
+
+//
+// Commit a change -- Validate it, write it, apply it to the metadata, flush it
+//
+// As for the File Storage, the flush comes after writeMu is released so
+// writers arriving meanwhile share it.
+//
+func (s *diskStorage) commit(rec logRecord) error {
+	seq, err := s.writeAndApply(rec)
+	if err != nil {
+		return err
+	}
+	return s.syncs.wait(seq) // Durable before the Client sees the Result
+}
+
+//
+// Write and apply a change (under writeMu) -- Returns the write to wait for
+//
+func (s *diskStorage) writeAndApply(rec logRecord) (int64, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.validate(&rec); err != nil { // Reject before anything is written
+		return 0, err
+	}
+	s.mu.RLock()
+	rec, err := logForm(rec, s.storedHistory) // Only the revisions rec adds
+	s.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	refs, err := s.write([]logRecord{rec})
+	if err != nil {
+		return 0, err
+	}
+	seq := s.syncs.wrote()
+	return seq, s.apply(rec, refs[0])
+}
+
+//
+// Apply a record at ref to the metadata and the record index
+//
+//	put    -- As for the File Storage
+//	delete -- As for the File Storage
+//	batch  -- As for the File Storage; each put points into the record
+//	page   -- The Page as it was, Version included (seed and compaction)
+//
+// A put that kept revisions is linked to the record of the Page it replaces.
+//
+func (s *diskStorage) apply(rec logRecord, ref recordRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch rec.Op {
+	case "put", "page":
+		if err := s.link(ref, rec.Page, rec.Kept); err != nil {
+			return err
+		}
+		p := metadata(rec.Page)
+		if rec.Op == "page" {
+			p.Version = 0 // Restored below
+		}
+		if err := s.put(p); err != nil {
+			return err
+		}
+		i := s.byName[p.Name]
+		if rec.Op == "page" && rec.Page.Version > 0 {
+			s.pages[i].Version = rec.Page.Version
+		}
+		s.refs[s.pages[i].ID] = ref
+		return nil
+	case "delete":
+		i, ok := s.byName[rec.Page.Name]
+		if !ok {
+			return errNotFound
+		}
+		id := s.pages[i].ID
+		if err := s.remove(rec.Page.Name); err != nil {
+			return err
+		}
+		delete(s.refs, id)
+		return nil
+	case "batch":
+		ops := make([]Op, len(rec.Batch))
+		var changed []string // IDs of Pages the Batch may delete
+		for i, op := range rec.Batch {
+			op.Page = metadata(op.Page)
+			ops[i] = op
+			if j, ok := s.byName[op.Name]; ok {
+				changed = append(changed, s.pages[j].ID)
+			}
+		}
+		if _, err := s.checkBatch(ops, time.Time{}); err != nil { // Checked when written
+			return err
+		}
+		for i, op := range rec.Batch { // Stored before the Batch -- See deltaPuts
+			if err := s.link(recordRef{Offset: ref.Offset, Length: ref.Length, Op: i}, op.Page, op.Kept); err != nil {
+				return err
+			}
+		}
+		if err := s.applyBatch(ops); err != nil {
+			return err
+		}
+		for _, id := range changed {
+			if _, ok := s.byID[id]; !ok {
+				delete(s.refs, id)
+			}
+		}
+		for i, op := range rec.Batch {
+			if _, ok := s.byID[op.Page.ID]; ok && op.Op == "put" {
+				s.refs[op.Page.ID] = recordRef{Offset: ref.Offset, Length: ref.Length, Op: i}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown record %q", rec.Op)
+}
+
+//
+// Link a record that kept revisions to the one of the Page it replaces (s.mu held)
+//
+func (s *diskStorage) link(ref recordRef, p Page, kept int) error {
+	if kept == 0 {
+		return nil
+	}
+	i, ok := s.byName[p.Name]
+	if !ok {
+		return fmt.Errorf("%q keeps %d revisions, no Page has them", p.Name, kept)
+	}
+	s.links[ref] = historyLink{Ref: ref, Prev: s.refs[s.pages[i].ID], Kept: kept, Logged: len(p.History)}
+	return nil
+}
+
+//
+// Records the History at ref is read from (s.mu held) -- ref, then as far back as revisions are kept
+//
+func (s *diskStorage) chain(ref recordRef) []recordRef {
+	refs := []recordRef{ref}
+	l, ok := s.links[ref]
+	need := l.Kept
+	for ok && need > 0 {
+		refs = append(refs, l.Prev)
+		if l, ok = s.links[l.Prev]; !ok || need <= l.Logged {
+			break
+		}
+		need = min(need-l.Logged, l.Kept)
+	}
+	return refs
+}
+
+//
+// Revisions of the Page stored under name (s.mu held) -- What a put is logged against
+//
+func (s *diskStorage) storedHistory(name string) ([]Revision, error) {
+	i, ok := s.byName[name]
+	if !ok {
+		return nil, nil
+	}
+	_, history, err := s.readPage(s.refs[s.pages[i].ID], true) // Read next, most likely
+	return history, err
+}
+
+//
+// Read the Body and revisions a record holds -- Through the cache
+//
+// keep is false for reads that should not push other Bodies out (List).
+//
+func (s *diskStorage) readPage(ref recordRef, keep bool) ([]byte, []Revision, error) {
+	if body, history, ok := s.cache.get(ref); ok {
+		return body, history, nil
+	}
+	p, err := s.readRecord(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	if l, ok := s.links[ref]; ok {
+		kept, err := s.readHistory(l.Prev, l.Kept)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.History = append(kept, p.History...)
+	}
+	if keep {
+		s.cache.add(ref, p.Body, p.History)
+	}
+	return p.Body, p.History, nil
+}
+
+//
+// Last n revisions of the Page at ref -- Only the records they are in are read
+//
+func (s *diskStorage) readHistory(ref recordRef, n int) ([]Revision, error) {
+	history, ok := []Revision(nil), false
+	if _, history, ok = s.cache.get(ref); !ok {
+		p, err := s.readRecord(ref)
+		if err != nil {
+			return nil, err
+		}
+		history = p.History
+		if l, ok := s.links[ref]; ok && n > len(history) {
+			kept, err := s.readHistory(l.Prev, min(n-len(history), l.Kept))
+			if err != nil {
+				return nil, err
+			}
+			history = append(kept, history...)
+		}
+	}
+	if n > len(history) {
+		return nil, fmt.Errorf("%s: record at %d: %d revisions kept, %d found", s.file, ref.Offset, n, len(history))
+	}
+	return append([]Revision(nil), history[len(history)-n:]...), nil // Never append into the cache
+}
+
+//
+// Page a record holds, as written -- Checked against its Sum
+//
+func (s *diskStorage) readRecord(ref recordRef) (Page, error) {
+	buf := make([]byte, ref.Length)
+	if _, err := s.f.ReadAt(buf, ref.Offset); err != nil {
+		return Page{}, fmt.Errorf("%s: record at %d: %v", s.file, ref.Offset, err)
+	}
+	rec, err := decodeRecord(buf)
+	if err != nil {
+		return Page{}, fmt.Errorf("%s: record at %d: %v", s.file, ref.Offset, err)
+	}
+	p := rec.Page
+	if ref.Op >= 0 {
+		if ref.Op >= len(rec.Batch) {
+			return Page{}, fmt.Errorf("%s: record at %d: no operation %d", s.file, ref.Offset, ref.Op)
+		}
+		p = rec.Batch[ref.Op].Page
+	}
+	if !checkLogSum(&p) {
+		return Page{}, fmt.Errorf("%s: record at %d: checksum mismatch", s.file, ref.Offset)
+	}
+	return p, nil
+}
+
+//
+// Page metadata with its Body and revisions read back
+//
+func (s *diskStorage) fill(p Page, ref recordRef, keep bool) Page {
+	body, history, err := s.readPage(ref, keep)
+	check("Disk Read Failed", err)
+	p.Body = body
+	p.History = history
+	return p
+}
+
+//
+// Get -- Metadata from memory, Body from the cache or disk
+//
+func (s *diskStorage) Get(name string) (Page, bool) {
+	s.mu.RLock() // Held for the read -- Restore swaps the file under s.mu
+	defer s.mu.RUnlock()
+	i, ok := s.byName[name]
+	if !ok {
+		return Page{}, false
+	}
+	return s.fill(s.pages[i], s.refs[s.pages[i].ID], true), true
+}
+
+//
+// GetID -- Metadata from memory, Body from the cache or disk
+//
+func (s *diskStorage) GetID(id string) (Page, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.byID[id]
+	if !ok {
+		return Page{}, false
+	}
+	return s.fill(s.pages[i], s.refs[id], true), true
+}
+
+//
+// List -- Every Page read back from disk, without disturbing the cache
+//
+func (s *diskStorage) List() []Page {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pages := append([]Page(nil), s.pages...)
+	for i, p := range pages {
+		pages[i] = s.fill(p, s.refs[p.ID], false)
+	}
+	return pages
+}
+
+//
+// List Metadata -- Every Page without reading a Body
+//
+func (s *diskStorage) ListMetadata() []Page {
+	return s.memStorage.List()
+}
+
+//
+// Search Metadata -- Pages with a Name containing substr, without reading a Body
+//
+func (s *diskStorage) SearchMetadata(substr string) []Page {
+	var pages []Page
+	for _, name := range s.memStorage.Search(substr) {
+		if p, ok := s.memStorage.Get(name); ok { // Deleted since the Search -- Left out
+			pages = append(pages, p)
+		}
+	}
+	return pages
+}
+
+//
+// Pages for a listing -- Without Bodies when the Storage can skip them
+//
+func listPages(s Storage) []Page {
+	if m, ok := s.(metadataLister); ok {
+		return m.ListMetadata()
+	}
+	return s.List()
+}
+
+//
+// Pages with a Name containing substr -- Without Bodies when the Storage can skip them
+//
+func searchPages(s Storage, substr string) []Page {
+	if m, ok := s.(metadataSearcher); ok {
+		return m.SearchMetadata(substr)
+	}
+	var pages []Page
+	for _, name := range s.Search(substr) {
+		if p, ok := s.Get(name); ok { // Deleted since the Search -- Left out
+			pages = append(pages, p)
+		}
+	}
+	return pages
+}
+
+//
+// Put -- Append the Page, then point the index at it
+//
+func (s *diskStorage) Put(p Page) error {
+	return s.commit(logRecord{Op: "put", Page: p})
+}
+
+//
+// Delete -- Append the delete, then drop the Page from the index
+//
+func (s *diskStorage) Delete(name string) error {
+	return s.commit(logRecord{Op: "delete", Page: Page{Name: name}})
+}
+
+//
+// Apply a Batch -- Checked in full, then one record for all of it
+//
+func (s *diskStorage) Apply(ops []Op) error {
+	return s.commit(logRecord{Op: "batch", Batch: ops})
+}
+
+//
+// Save the index -- Written to Data.pages.idx.tmp and renamed into place
+//
+func (s *diskStorage) saveIndex() error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	s.writeMu.Lock() // Size and index must match
+	s.mu.Lock()      // Links no longer read from are dropped
+	idx := diskIndex{Size: s.size, Pages: append([]Page(nil), s.pages...), Refs: make([]recordRef, len(s.pages))}
+	links := map[recordRef]historyLink{} // Only those still read from
+	for i, p := range idx.Pages {
+		idx.Refs[i] = s.refs[p.ID]
+		for _, r := range s.chain(idx.Refs[i]) {
+			if l, ok := s.links[r]; ok {
+				links[r] = l
+			}
+		}
+	}
+	s.links = links
+	s.mu.Unlock()
+	for _, l := range links {
+		idx.Links = append(idx.Links, l)
+	}
+	s.writeMu.Unlock()
+
+	data, err := json.Marshal(idx)
+	if err == nil {
+		data, err = sealFile(data) // Names are data too
+	}
+	if err != nil {
+		return err
+	}
+	tmp := s.index + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.index); err != nil {
+		return err
+	}
+	s.indexed = idx.Size
+	return nil
+}
+
+//
+// Index Saver -- Save the index every interval while records were added
+//
+func (s *diskStorage) indexSaver(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-tick.C:
+		}
+		s.writeMu.Lock()
+		size := s.size
+		s.writeMu.Unlock()
+		s.indexMu.Lock()
+		pending := size != s.indexed
+		s.indexMu.Unlock()
+		if pending {
+			if err := s.saveIndex(); err != nil {
+				fmt.Println("Index Save Failed:", err)
+			}
+		}
+	}
+}
+
+//
+// Compact -- Rewrite Data.pages with one record per live Page
+//
+// Only run while opening, before anything else uses the Storage. Each
+// record holds the whole History, pruned to the revision limits.
+//
+func (s *diskStorage) compact() error {
+	fmt.Println("Compacting", s.file)
+	pages, t := s.List(), now()
+	for i := range pages {
+		pages[i].History = pruneHistory(pages[i].History, t)
+	}
+	if err := s.rewrite(pages); err != nil {
+		return err
+	}
+	return s.saveIndex()
+}
+
+//
+// Restore -- Rewrite Data.pages with pages, then swap it in under one lock
+//
+func (s *diskStorage) Restore(pages []Page) error {
+	if err := s.rewrite(pages); err != nil {
+		return err
+	}
+	return s.saveIndex()
+}
+
+//
+// Rewrite Data.pages -- One "page" record per Page, renamed over the old file
+//
+// The new file is written and flushed beside Data.pages; readers keep the
+// old one until the swap. A crash leaves one file or the other, complete.
+// Every Page must have an ID.
+//
+func (s *diskStorage) rewrite(pages []Page) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	recs := make([]logRecord, len(pages))
+	for i, p := range pages {
+		recs[i] = logRecord{Op: "page", Page: p}
+	}
+	data, refs, err := encodeRecords(recs, 0)
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	os.Remove(s.index) // Never left pointing into the new file
+	if err := os.Rename(tmp, s.file); err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncDir(filepath.Dir(s.file)); err != nil {
+		f.Close()
+		return err
+	}
+
+	meta := make([]Page, len(pages))
+	byID := make(map[string]recordRef, len(pages))
+	for i, p := range pages {
+		meta[i] = metadata(p)
+		byID[p.ID] = refs[i]
+	}
+	s.fileMu.Lock() // No fsync of the old file from here on
+	s.mu.Lock()     // No read of it either
+	old := s.f
+	s.f, s.size = f, int64(len(data))
+	s.replace(meta)
+	s.refs = byID
+	s.links = map[recordRef]historyLink{} // Every record holds its whole History
+	s.cache.clear()                       // Offsets now point into the new file
+	s.mu.Unlock()
+	s.fileMu.Unlock()
+	return old.Close()
+}
+
+//
+// Close -- Flush what -fsync left, save the index and close Data.pages
+//
+func (s *diskStorage) Close() error {
+	close(s.done)
+	err := s.syncs.stop()
+	if ierr := s.saveIndex(); err == nil {
+		err = ierr
+	}
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,176 @@
+// disk_test - Test Suite for the db_demo Disk Storage and Body Cache.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+//
+// Test the LRU Cache -- Bounded in bytes, least recently used dropped first
+//
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(10)
+	ref := func(i int) recordRef { return recordRef{Offset: int64(i), Op: -1} }
+
+	c.add(ref(1), []byte("aaaa"), nil)
+	c.add(ref(2), []byte("bb"), []Revision{{Rev: 1, Body: []byte("bb")}}) // Revisions count too
+	c.get(ref(1))                                                         // 1 is now the most recent
+	c.add(ref(3), []byte("cccc"), nil)                                    // 12 bytes -- 2 goes
+	c.add(ref(4), []byte("this is over the limit"), nil)                  // Never cached
+
+	cases := []struct {
+		ref  recordRef
+		body string
+		ok   bool
+	}{
+		{ref(1), "aaaa", true},
+		{ref(2), "", false},
+		{ref(3), "cccc", true},
+		{ref(4), "", false},
+	}
+	for _, c2 := range cases {
+		body, _, ok := c.get(c2.ref)
+		if ok != c2.ok || string(body) != c2.body {
+			t.Errorf("get(%v) = %q, %v; Expected %q, %v", c2.ref, body, ok, c2.body, c2.ok)
+		}
+	}
+	if size, entries, hits, misses := c.stats(); size != 8 || entries != 2 || hits != 3 || misses != 2 {
+		t.Errorf("stats = %d bytes, %d entries, %d hits, %d misses", size, entries, hits, misses)
+	}
+}
+
+//
+// Test the Disk Storage -- Bodies come back from disk, before and after a restart
+//
+func TestDiskStorage(t *testing.T) {
+	removeDatabase()
+	defer removeDatabase()
+	s, err := openDiskStorage(pagesFile, 16)
+	testCheck(err)
+	testCheck(s.Put(Page{Name: "Ann", Body: []byte("New Ann Data")}))
+	testCheck(s.Delete("Mike"))
+	testCheck(s.Apply([]Op{
+		{Op: "put", Page: Page{Name: "Henry", Body: []byte("Henry Data")}},
+		{Op: "rename", Name: "Jack", NewName: "John"},
+	}))
+	want := []string{"Charles=Charles Data", "Ann=New Ann Data", "John=Jack Data", "Jacky=Jacky Data", "Henry=Henry Data"}
+	if got := namesAndBodies(s.List()); !reflect.DeepEqual(got, want) {
+		t.Errorf("\n\tExpected:\t%q\n\tGot:\t%q", want, got)
+	}
+
+	for _, name := range []string{"Charles", "Ann", "John", "Jacky", "Henry"} {
+		if _, ok := s.Get(name); !ok {
+			t.Errorf("Get(%q) failed", name)
+		}
+	}
+	if size, _, _, _ := s.cache.stats(); size > 16 {
+		t.Errorf("cache holds %d bytes, limit 16", size)
+	}
+	if s.memStorage.pages[0].Body != nil {
+		t.Error("Body kept in memory: ", s.memStorage.pages[0])
+	}
+	if p, _ := s.Get("Ann"); p.Version != 2 || len(p.ID) <= 0 {
+		t.Errorf("Ann = Version %d, ID %q", p.Version, p.ID)
+	}
+	before := s.List()
+	testCheck(s.Close())
+
+	reopen := []struct {
+		name    string
+		prepare func()
+	}{
+		{"saved index", func() {}},
+		{"full scan", func() { os.Remove(pagesFile + ".idx") }},
+		{"stale index", func() {
+			f, err := os.OpenFile(pagesFile, os.O_WRONLY|os.O_TRUNC, 0644) // Shorter than the index says
+			testCheck(err)
+			f.Close()
+		}},
+	}
+	for _, c := range reopen {
+		c.prepare()
+		s, err = openDiskStorage(pagesFile, 16)
+		testCheck(err)
+		expected := before
+		if c.name == "stale index" {
+			expected = nil // Every record is gone with the file
+		}
+		if got := s.List(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s:\n\tExpected:\t%v\n\tGot:\t%v", c.name, expected, got)
+		}
+		testCheck(s.Close())
+	}
+}
+
+//
+// Test a torn last record -- Dropped, the ones before it kept
+//
+func TestDiskTornRecord(t *testing.T) {
+	removeDatabase()
+	defer removeDatabase()
+	s, err := openDiskStorage(pagesFile, 1<<20)
+	testCheck(err)
+	testCheck(s.Close())
+	s, err = openDiskStorage(pagesFile, 1<<20)
+	testCheck(err)
+	testCheck(s.Put(Page{Name: "Ann", Body: []byte("New Ann Data")}))
+	s.f.Close() // Crash -- No index saved
+	close(s.done)
+
+	f, err := os.OpenFile(pagesFile, os.O_WRONLY|os.O_APPEND, 0644)
+	testCheck(err)
+	f.Write([]byte(`{"Op":"put","Page":{"Name":"Ann","Bo`))
+	f.Close()
+
+	s, err = openDiskStorage(pagesFile, 1<<20)
+	testCheck(err)
+	defer s.Close()
+	if p, _ := s.Get("Ann"); string(p.Body) != "New Ann Data" {
+		t.Errorf("Ann = %q after a torn record", p.Body)
+	}
+	data, err := ioutil.ReadFile(pagesFile)
+	testCheck(err)
+	if !bytes.HasSuffix(data, []byte("}\n")) {
+		t.Error("torn record left in ", pagesFile)
+	}
+}
+
+//
+// Test import and compaction -- Data.db seeds Data.pages, old records are dropped on open
+//
+func TestDiskImportAndCompact(t *testing.T) {
+	removeDatabase()
+	defer removeDatabase()
+	fs, err := openFileStorage(dataFile, "json") // Data.db with the Test Data
+	testCheck(err)
+	testCheck(fs.Put(Page{Name: "Henry", Body: []byte("Henry Data")}))
+	want := namesAndBodies(fs.List())
+	testCheck(fs.Close())
+
+	s, err := openDiskStorage(pagesFile, 1<<20)
+	testCheck(err)
+	if got := namesAndBodies(s.List()); !reflect.DeepEqual(got, want) {
+		t.Errorf("import:\n\tExpected:\t%q\n\tGot:\t%q", want, got)
+	}
+	big := bytes.Repeat([]byte("x"), 100<<10)
+	for i := 0; i < 15; i++ {
+		big[0] = byte('a' + i)
+		testCheck(s.Put(Page{Name: "Henry", Body: big}))
+	}
+	before := s.List()
+	testCheck(s.Close())
+
+	s, err = openDiskStorage(pagesFile, 1<<20)
+	testCheck(err)
+	defer s.Close()
+	if info, _ := os.Stat(pagesFile); info.Size() > 200<<10 {
+		t.Errorf("%s still %d bytes after compaction", pagesFile, info.Size())
+	}
+	if got := s.List(); !reflect.DeepEqual(got, before) {
+		t.Error("compaction changed the Pages")
+	}
+}
@@ -0,0 +1,75 @@
+// etag - Optimistic Concurrency for Saves.
+// Every Put bumps Page.Version, which /view/ and /edit/ send as the ETag.
+// A save names the Version it started from -- the edit form's hidden
+// "version" field or an If-Match header -- and is refused if the Page has
+// changed since: 409 Conflict for the form, 412 Precondition Failed for
+// If-Match, both with the two versions side by side.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//
+// ETag of a Page -- Its Version, quoted
+//
+func etag(p Page) string {
+	return fmt.Sprintf("\"%d\"", p.Version)
+}
+
+//
+// Version a save expects -- Zero saves over any Version
+//
+// From If-Match (ifMatch is true) or else the form's "version" field.
+// A tag that is not a Version of current gives -1, which never matches.
+//
+func expectedVersion(r *http.Request, current Page) (version int, ifMatch bool) {
+	if h := r.Header.Get("If-Match"); len(h) > 0 {
+		if strings.TrimSpace(h) == "*" {
+			return 0, true // Any Version -- The Page only has to exist
+		}
+		for _, tag := range strings.Split(h, ",") {
+			n, err := strconv.Atoi(strings.Trim(strings.TrimSpace(tag), "\""))
+			if err == nil && n == current.Version {
+				return n, true
+			}
+		}
+		return -1, true
+	}
+	if v := r.FormValue("version"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return -1, false
+		}
+		return n, false
+	}
+	return 0, false
+}
+
+//
+// Conflict Page -- The rejected Body next to the current one
+//
+// The form saves the rejected Body again over the current Version.
+//
+func writeConflict(w http.ResponseWriter, status int, name string, current Page, body string) {
+	state := fmt.Sprint("Current version ", current.Version)
+	if current.Version == 0 {
+		state = "Deleted since you read it"
+	} else {
+		w.Header().Set("ETag", etag(current))
+	}
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<h1>Conflict: %s was changed by someone else</h1>"+
+		"<h2>Your version</h2>"+
+		"<form action=\"/save/%s\" method=\"POST\">"+
+		"<textarea name=\"body\" rows=\"10\" cols=\"80\">%s</textarea><br>"+
+		"<input type=\"hidden\" name=\"version\" value=\"%d\">"+
+		"<input type=\"submit\" value=\"Save Anyway\">"+
+		"</form>"+
+		"<h2>%s</h2>"+
+		"<textarea nameM=\"body\" rows=\"10\" cols=\"80\">%s</textarea><br>",
+		name, name, body, current.Version, state, current.Body)
+}
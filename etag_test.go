@@ -0,0 +1,154 @@
+// etag_test - Test Suite for the db_demo Optimistic Concurrency.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//
+// POST /save/ with an If-Match header
+//
+func ifMatchRequest(url, tag, body string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("POST", url, strings.NewReader(body))
+	testCheck(err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("If-Match", tag)
+	w := httptest.NewRecorder()
+	saveHandler(w, r)
+	return w
+}
+
+//
+// Test Put Versions -- Both backends bump them and refuse stale ones
+//
+func TestVersionCheck(t *testing.T) {
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+	for _, kind := range []string{"file", "disk", "memory"} {
+		removeDatabase()
+		*storageKind = kind
+		loadDatabase()
+
+		if p, _ := db.Get("Ann"); p.Version != 1 {
+			t.Errorf("%s: loaded Version = %d, Expected 1", kind, p.Version)
+		}
+		testCheck(db.Put(Page{Name: "Ann", Body: []byte("one")}))             // Unconditional
+		testCheck(db.Put(Page{Name: "Ann", Body: []byte("two"), Version: 2})) // Current
+		err := db.Put(Page{Name: "Ann", Body: []byte("three"), Version: 2})   // Stale
+		if err != errConflict {
+			t.Errorf("%s: stale Put returned %v", kind, err)
+		}
+		if err := db.Put(Page{Name: "Henry", Version: 1}); err != errConflict {
+			t.Errorf("%s: Put expecting a missing Page returned %v", kind, err)
+		}
+		testCheck(db.Put(Page{Name: "Henry", Body: []byte("new"), Version: versionNew})) // Created
+		if err := db.Put(Page{Name: "Henry", Body: []byte("again"), Version: versionNew}); err != errConflict {
+			t.Errorf("%s: second create returned %v", kind, err)
+		}
+		if p, _ := db.Get("Ann"); p.Version != 3 || string(p.Body) != "two" {
+			t.Errorf("%s: Ann = Version %d, %q; Expected Version 3, \"two\"", kind, p.Version, p.Body)
+		}
+		if kind != "memory" {
+			loadDatabase() // Refused Puts never reach the Log
+			if p, _ := db.Get("Ann"); p.Version != 3 || string(p.Body) != "two" {
+				t.Errorf("%s: replayed Ann = Version %d, %q", kind, p.Version, p.Body)
+			}
+		}
+	}
+	removeDatabase()
+}
+
+//
+// Test stale saves -- The form gets 409, If-Match gets 412, neither overwrites
+//
+func TestStaleSave(t *testing.T) {
+	testDatabase([]byte(cajmj_db))
+
+	edit := testRequest(editHandler, "GET", "/edit/Ann", "")
+	if tag := edit.Header().Get("ETag"); tag != "\"1\"" || !strings.Contains(edit.Body.String(), "name=\"version\" value=\"1\"") {
+		t.Fatalf("Edit form: ETag %s, %q", tag, edit.Body.String())
+	}
+	first := testRequest(saveHandler, "POST", "/save/Ann", "body=First&version=1")
+	if first.Code != http.StatusFound || first.Header().Get("ETag") != "\"2\"" {
+		t.Errorf("First save: %d, ETag %s", first.Code, first.Header().Get("ETag"))
+	}
+	second := testRequest(saveHandler, "POST", "/save/Ann", "body=Second&version=1")
+	if second.Code != http.StatusConflict || !strings.Contains(second.Body.String(), "Second") ||
+		!strings.Contains(second.Body.String(), "First") || !strings.Contains(second.Body.String(), "value=\"2\"") {
+		t.Errorf("Stale save: %d %q", second.Code, second.Body.String())
+	}
+	if p, _ := db.Get("Ann"); string(p.Body) != "First" {
+		t.Errorf("Stale save overwrote Ann: %q", p.Body)
+	}
+
+	cases := []struct {
+		tag  string
+		body string
+		code int
+	}{
+		{"\"2\"", "Third", http.StatusFound},
+		{"\"2\"", "Fourth", http.StatusPreconditionFailed},
+		{"\"1\", \"3\"", "Fifth", http.StatusFound},
+		{"W/\"4\"", "Sixth", http.StatusPreconditionFailed},
+		{"*", "Seventh", http.StatusFound},
+	}
+	for _, c := range cases {
+		if w := ifMatchRequest("/save/Ann", c.tag, "body="+c.body); w.Code != c.code {
+			t.Errorf("If-Match: %s, %s = %d, Expected %d", c.tag, c.body, w.Code, c.code)
+		}
+	}
+	view := testRequest(viewHandler, "GET", "/view/Ann", "")
+	if tag := view.Header().Get("ETag"); tag != "\"5\"" || !strings.Contains(view.Body.String(), "Seventh") {
+		t.Errorf("View: ETag %s, %q", tag, view.Body.String())
+	}
+}
+
+//
+// Test concurrent saves without a Version -- Every Body is kept as a revision
+//
+func TestConcurrentSaves(t *testing.T) {
+	testDatabase([]byte(cajmj_db))
+	var wg sync.WaitGroup
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			testRequest(saveHandler, "POST", "/save/Ann", fmt.Sprint("body=Writer ", g))
+		}(g)
+	}
+	wg.Wait()
+	p, _ := db.Get("Ann")
+	if p.Rev != 10 || len(p.History) != 10 || p.Version != 11 {
+		t.Errorf("Ann: Rev %d, %d revisions, Version %d; Expected 10, 10, 11", p.Rev, len(p.History), p.Version)
+	}
+}
+
+type racingStorage struct { // Storage where another Client creates the Page right after the first Get
+	Storage
+	once sync.Once
+}
+
+func (s *racingStorage) Get(name string) (Page, bool) {
+	p, ok := s.Storage.Get(name)
+	s.once.Do(func() { testCheck(s.Storage.Put(Page{Name: name, Body: []byte("Other"), Rev: 1, Saved: now()})) })
+	return p, ok
+}
+
+//
+// Test a create racing another -- Saved over the Page created first, which is kept as a revision
+//
+func TestRacingCreate(t *testing.T) {
+	testDatabase([]byte(cajmj_db))
+	mem := db
+	defer func() { db = mem }()
+	db = &racingStorage{Storage: mem}
+	testCheck((&Page{Name: "Henry", Body: []byte("Mine")}).save())
+	p, _ := mem.Get("Henry")
+	if string(p.Body) != "Mine" || p.Rev != 2 || len(p.History) != 1 || string(p.History[0].Body) != "Other" {
+		t.Errorf("Henry: %q, Rev %d, History %v; Expected \"Mine\" over \"Other\"", p.Body, p.Rev, p.History)
+	}
+}
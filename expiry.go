@@ -0,0 +1,115 @@
+// expiry - Page Expiry (TTL).
+// A Page can be given an Expires time on save, in a batch or through
+// Storage.Put. From then on the lookups and views treat it as gone, and
+// the Sweeper deletes it for good through the Storage, so the delete is
+// written like any other.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var sweepInterval = flag.Duration("sweep", time.Minute, "How often expired Pages are deleted")
+
+//
+// Live -- Page is not in the trash and has not expired
+//
+func live(p Page, t time.Time) bool {
+	return p.Deleted.IsZero() && !expired(p, t)
+}
+
+//
+// Expired -- Page has an Expires time and it has passed
+//
+func expired(p Page, t time.Time) bool {
+	return !p.Expires.IsZero() && !t.Before(p.Expires)
+}
+
+//
+// Parse an expiry -- A duration from t ("90m", "24h") or an RFC 3339 time
+//
+// An empty string or "never" means the Page never expires.
+//
+func parseExpires(s string, t time.Time) (time.Time, error) {
+	if len(s) <= 0 || s == "never" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return t.Add(d), nil
+	}
+	e, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expiry %q is neither a duration (24h), a time (2006-01-02T15:04:05Z) nor never", s)
+	}
+	return e.UTC(), nil
+}
+
+//
+// Expiry as shown in the edit form -- Empty for never
+//
+func formatExpires(p Page) string {
+	if p.Expires.IsZero() {
+		return ""
+	}
+	return p.Expires.Format(time.RFC3339)
+}
+
+//
+// Sweep -- Delete every Page expired at t, returns how many went
+//
+// Each delete names the Version that expired, so a Page saved again in
+// the meantime is left alone. An expired Page goes even from the trash:
+// its expiry was asked for, the trash only keeps what /delete/ removed.
+//
+func sweepExpired(s Storage, t time.Time) (int, error) {
+	swept := 0
+	for _, p := range listPages(s) {
+		if !expired(p, t) {
+			continue
+		}
+		ok, err := deleteVersion(s, p)
+		if err != nil {
+			return swept, err
+		}
+		if ok {
+			swept++
+		}
+	}
+	return swept, nil
+}
+
+//
+// Delete a Page as listed -- false if it was saved again or deleted since
+//
+// A purge, not a delete: the Page is already hidden from a delete.
+//
+func deleteVersion(s Storage, p Page) (bool, error) {
+	err := s.Apply([]Op{{Op: "purge", Name: p.Name, Version: p.Version}})
+	if be, ok := err.(*batchError); ok && (be.Err == errConflict || be.Err == errNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//
+// Sweeper -- Sweep the database and purge the Trash every interval
+//
+func expirySweeper(interval time.Duration) {
+	for range time.Tick(interval) {
+		if n, err := sweepExpired(db, now()); err != nil {
+			fmt.Println("Sweep Failed:", err)
+		} else if n > 0 {
+			fmt.Println("Swept", n, "expired pages")
+		}
+		if *trashPurge <= 0 {
+			continue // Trash kept for good
+		}
+		if n, err := purgeTrash(db, now(), *trashPurge); err != nil {
+			fmt.Println("Purge Failed:", err)
+		} else if n > 0 {
+			fmt.Println("Purged", n, "pages from the trash")
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// expiry_test - Test Suite for the db_demo Page Expiry.
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Test parseExpires -- Durations from now, RFC 3339 times, blank for never
+//
+func TestParseExpires(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		{"", time.Time{}, true},
+		{"never", time.Time{}, true},
+		{"90m", t0.Add(90 * time.Minute), true},
+		{"2024-06-01T00:00:00Z", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2024-06-01T02:00:00+02:00", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), true},
+		{"tomorrow", time.Time{}, false},
+	}
+	for _, c := range cases {
+		got, err := parseExpires(c.s, t0)
+		if (err == nil) != c.ok || !got.Equal(c.want) {
+			t.Errorf("parseExpires(%q) = %v, %v; Expected %v", c.s, got, err, c.want)
+		}
+	}
+}
+
+//
+// Test expired Pages -- Invisible to the lookups and /view/ before the Sweep
+//
+func TestExpiredHidden(t *testing.T) {
+	testDatabase([]byte(cajmj_db))
+	testCheck(db.Put(Page{Name: "Ann", Body: []byte("Ann Data"), Expires: now().Add(-time.Second)}))
+	testCheck(db.Put(Page{Name: "Mike", Body: []byte("Mike Data"), Expires: now().Add(time.Hour)}))
+
+	if _, ok := findName(db, "Ann"); ok {
+		t.Error("findName found an expired Page")
+	}
+	if _, ok := findExactName(db, "Ann"); ok {
+		t.Error("findExactName found an expired Page")
+	}
+	if p, ok := findName(db, "Mike"); !ok || p.Name != "Mike" {
+		t.Error("Page that expires later not found")
+	}
+	ann, _ := db.Get("Ann")
+	cases := []struct {
+		h    http.HandlerFunc
+		url  string
+		want string
+	}{
+		{viewHandler, "/view/Ann", "Name not found!"},
+		{idHandler, "/id/" + ann.ID, "ID not found!"},
+		{viewHandler, "/view/", "Record  0 :  Charles \nRecord  1 :  Jack \nRecord  2 :  Mike \nRecord  3 :  Jacky"},
+	}
+	for _, c := range cases {
+		if got := testRequest(c.h, "GET", c.url, "").Body.String(); !strings.Contains(got, c.want) {
+			t.Errorf("%s = %q\n\tExpected it to contain %q", c.url, got, c.want)
+		}
+	}
+}
+
+//
+// Test expiry on save and in a batch
+//
+func TestSaveExpires(t *testing.T) {
+	testDatabase([]byte(cajmj_db))
+	before := now()
+	testRequest(saveHandler, "POST", "/save/Ann", "body=Ann Data&expires=1h")
+	p, _ := db.Get("Ann")
+	if p.Expires.Before(before.Add(time.Hour)) || p.Expires.After(now().Add(time.Hour)) || p.Rev != 0 {
+		t.Errorf("expires=1h: Expires %v, Rev %d -- Expected an hour from now, no new revision", p.Expires, p.Rev)
+	}
+	if edit := testRequest(editHandler, "GET", "/edit/Ann", "").Body.String(); !strings.Contains(edit, formatExpires(p)) {
+		t.Errorf("Edit form does not show the expiry: %q", edit)
+	}
+	testRequest(saveHandler, "POST", "/save/Ann", "body=Ann 2") // No expires field -- Kept
+	if q, _ := db.Get("Ann"); !q.Expires.Equal(p.Expires) {
+		t.Errorf("Save without expires changed it: %v", q.Expires)
+	}
+	if w := testRequest(saveHandler, "POST", "/save/Ann", "body=Ann 3&expires=soon"); w.Code != http.StatusBadRequest {
+		t.Errorf("Bad expiry = %d %q", w.Code, w.Body.String())
+	}
+	testRequest(saveHandler, "POST", "/save/Ann", "body=Ann 2&expires=")
+	if q, _ := db.Get("Ann"); !q.Expires.IsZero() {
+		t.Errorf("Blank expires did not clear it: %v", q.Expires)
+	}
+
+	testRequest(batchHandler, "POST", "/batch/", "[{\"Op\":\"put\",\"Name\":\"Session\",\"Body\":\"x\",\"Expires\":\"30m\"}]")
+	if q, _ := db.Get("Session"); q.Expires.IsZero() {
+		t.Error("Batch put without the expiry: ", q)
+	}
+	if w := testRequest(batchHandler, "POST", "/batch/", "[{\"Op\":\"put\",\"Name\":\"Session\",\"Expires\":\"x\"}]"); w.Code != http.StatusBadRequest {
+		t.Errorf("Batch with a bad expiry = %d %q", w.Code, w.Body.String())
+	}
+	session, _ := db.Get("Session")
+	testRequest(batchHandler, "POST", "/batch/", "[{\"Op\":\"put\",\"Name\":\"Session\",\"Body\":\"y\"}]") // Blank -- Kept, as for /save/
+	if q, _ := db.Get("Session"); !q.Expires.Equal(session.Expires) {
+		t.Errorf("Batch put without an expiry changed it: %v, was %v", q.Expires, session.Expires)
+	}
+	testRequest(batchHandler, "POST", "/batch/", "[{\"Op\":\"put\",\"Name\":\"Session\",\"Body\":\"z\",\"Expires\":\"never\"}]")
+	if q, _ := db.Get("Session"); !q.Expires.IsZero() {
+		t.Errorf("Expires never did not clear it: %v", q.Expires)
+	}
+	if w := testRequest(batchHandler, "POST", "/batch/", "[{\"Op\":\"purge\",\"Name\":\"Session\"}]"); w.Code != http.StatusBadRequest {
+		t.Errorf("Batch purge = %d %q", w.Code, w.Body.String())
+	}
+}
+
+//
+// Test the Sweep -- Expired Pages are deleted and stay deleted after a restart
+//
+func TestSweepExpired(t *testing.T) {
+	freshDatabase()
+	defer removeDatabase()
+	testCheck(db.Put(Page{Name: "Ann", Body: []byte("Ann Data"), Expires: now().Add(-time.Minute)}))
+	testCheck(db.Put(Page{Name: "Jack", Body: []byte("Jack Data"), Expires: now().Add(-time.Second)}))
+	testCheck(db.Put(Page{Name: "Mike", Body: []byte("Mike Data"), Expires: now().Add(time.Hour)}))
+
+	jack, _ := db.Get("Jack")
+	err := db.Apply([]Op{{Op: "purge", Name: "Jack", Version: jack.Version - 1}}) // Saved again since it was read
+	if be, ok := err.(*batchError); !ok || be.Err != errConflict {
+		t.Error("Purge of a changed Version = ", err)
+	}
+
+	if n, err := sweepExpired(db, now()); n != 2 || err != nil {
+		t.Errorf("sweepExpired = %d, %v; Expected 2", n, err)
+	}
+	loadDatabase()
+	want := []string{"Charles=Charles Data", "Mike=Mike Data", "Jacky=Jacky Data"}
+	if got := namesAndBodies(db.List()); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("After Sweep and restart = %q, Expected %q", got, want)
+	}
+	testCheck(trashPage(db, "Mike", now()))
+	if n, _ := sweepExpired(db, now().Add(2*time.Hour)); n != 1 {
+		t.Errorf("Later Sweep = %d, Expected Mike -- Expired in the trash", n)
+	}
+}
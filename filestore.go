@@ -0,0 +1,257 @@
+// filestore - JSON File Storage for the db_demo database.
+// The Pages are held in memory; Data.db holds the last Snapshot and
+// Data.log every change made since (see wal.go).
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dataFile = "Data.db" // Database Snapshot File
+
+type fileStorage struct { // JSON File Storage
+	*memStorage             // In-memory copy of the Database
+	file        string      // Snapshot: Data.db
+	prev        string      // Previous good generation: Data.db.prev
+	temp        string      // Snapshot being written: Data.db.tmp
+	log         string      // Write-Ahead Log: Data.log
+	encoding    string      // Snapshot encoding written: "json" or "binary"
+	logMu       sync.Mutex  // Serializes changes, Log appends and Checkpoints
+	logRecords  int         // Number of changes in the Log since the last Checkpoint
+	syncs       *syncer     // Flushes Data.log as -fsync asks (fsync.go)
+	snapshotSum uint32      // CRC32 of the current Snapshot
+	unsaved     bool        // Upgraded or given IDs at load -- not on disk yet
+	stamp       os.FileInfo // Data.db as last read or written here (logMu)
+	done        chan bool   // Stops the Checkpointer and the Reloader
+}
+
+//
+// Open File Storage -- Last Snapshot plus the Write-Ahead Log
+//
+// Snapshots are written with encoding; either encoding is read.
+// A missing or corrupt Snapshot falls back to the previous generation.
+// The test data is only created when no database files exist at all --
+// existing data is never reseeded.
+//
+func openFileStorage(file, encoding string) (*fileStorage, error) {
+	if encoding != "json" && encoding != "binary" {
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+	s := newFileStorage(file, encoding)
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.syncs.start(); err != nil {
+		return nil, err
+	}
+	s.stampFile()
+	go s.checkpointer(time.Minute) // Fold the Log into the Snapshot in the background
+	if *reloadInterval > 0 {
+		go s.reloader(*reloadInterval) // Pick up a Data.db changed by others (reload.go)
+	}
+	return s, nil
+}
+
+//
+// New empty File Storage for file -- Nothing is read or written yet
+//
+func newFileStorage(file, encoding string) *fileStorage {
+	s := &fileStorage{
+		memStorage: newMemStorage(nil),
+		file:       file,
+		prev:       file + ".prev",
+		temp:       file + ".tmp",
+		log:        strings.TrimSuffix(file, ".db") + ".log",
+		encoding:   encoding,
+		done:       make(chan bool),
+	}
+	s.syncs = newSyncer(*fsyncPolicy, s.syncLog)
+	return s
+}
+
+//
+// Load the Snapshot, or the previous generation, and replay the Log
+//
+func (s *fileStorage) load() error {
+	os.Remove(s.temp) // Left over from a crash during writeData
+
+	pages, data, version, err := readSnapshot(s.file)
+	if err == nil {
+		s.unsaved = missingIDs(pages)
+		if version < formatVersion { // Old format -- Keep a backup, upgrade in place
+			if err := s.keepBackup(data, version); err != nil {
+				return err
+			}
+			s.unsaved = true
+		}
+		s.reset(pages)
+		s.snapshotSum = crc32.ChecksumIEEE(data) // The Log was written against the original file
+		if err := s.replayLog(); err != nil {    // Apply changes made since the Snapshot
+			return err
+		}
+		if s.unsaved {
+			return s.checkpoint() // Write the upgraded format and the IDs just assigned
+		}
+		return nil
+	}
+	if _, ok := err.(newerFormatError); ok {
+		return err // Never fall back over data a newer program wrote
+	}
+	if _, ok := err.(keyError); ok {
+		return err // Wrong key -- The previous generation has the same one
+	}
+	if !os.IsNotExist(err) {
+		fmt.Println(s.file, "is corrupt:", err)
+	}
+	prevPages, prevData, _, prevErr := readSnapshot(s.prev)
+	if prevErr == nil { // Fall back to the previous good generation
+		fmt.Println("Loading previous generation", s.prev)
+		s.reset(prevPages)
+		s.snapshotSum = crc32.ChecksumIEEE(prevData)
+		if _, err := os.Stat(s.file); err == nil { // Keep the damaged file for inspection
+			fmt.Println("Damaged", s.file, "kept as", s.file+".corrupt")
+			if err := os.Rename(s.file, s.file+".corrupt"); err != nil {
+				return err
+			}
+		}
+		if _, err := os.Stat(s.log); err == nil { // Log belongs to the lost generation
+			fmt.Println("Log does not apply - kept as", s.log+".orphan")
+			if err := os.Rename(s.log, s.log+".orphan"); err != nil {
+				return err
+			}
+		}
+		return s.checkpoint() // Make the previous generation current again
+	}
+	if !os.IsNotExist(err) || !os.IsNotExist(prevErr) {
+		return fmt.Errorf("refusing to start, no good generation of %s: %v; %v", s.file, err, prevErr)
+	}
+	if _, err := os.Stat(s.log); err == nil {
+		return fmt.Errorf("refusing to start: %s present without %s", s.log, s.file)
+	}
+	s.reset(testData())   // New Database
+	return s.checkpoint() // Write Snapshot and start a new Log
+}
+
+//
+// Keep an old format Data.db as Data.db.v<version>.bak before it is upgraded
+//
+func (s *fileStorage) keepBackup(data []byte, version int) error {
+	backup := fmt.Sprintf("%s.v%d.bak", s.file, version)
+	fmt.Printf("Upgrading %s from format %d to %d - backup in %s\n", s.file, version, formatVersion, backup)
+	return ioutil.WriteFile(backup, data, 0644)
+}
+
+//
+// Missing IDs -- Pages written before stable IDs
+//
+func missingIDs(pages []Page) bool {
+	for _, p := range pages {
+		if len(p.ID) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Read and validate a Snapshot file -- Returns the Pages, the raw data and its format Version
+//
+func readSnapshot(file string) ([]Page, []byte, int, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	pages, version, err := decodeSnapshot(data)
+	if _, ok := err.(newerFormatError); ok {
+		return nil, nil, version, err
+	}
+	if e, ok := err.(keyError); ok {
+		return nil, nil, version, keyError{file + ": " + e.msg}
+	}
+	if err != nil { // Truncated or damaged file
+		return nil, nil, version, fmt.Errorf("%s: %v", file, err)
+	}
+	return pages, data, version, nil
+}
+
+//
+// Write Data Set to Disk -- Atomically
+//
+// The data goes to Data.db.tmp and is fsynced, the current Data.db is kept
+// as Data.db.prev, then Data.db.tmp is renamed over Data.db and the
+// directory is fsynced. A crash at any point leaves a complete Data.db.
+//
+func (s *fileStorage) writeData(data []byte) error { // Write "Mashalled" data to external device
+	f, err := os.OpenFile(s.temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	os.Remove(s.prev)             // Keep one previous generation
+	err = os.Link(s.file, s.prev) // Data.db stays in place until the rename
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(s.temp, s.file); err != nil { // Atomic replace
+		return err
+	}
+	return syncDir(filepath.Dir(s.file))
+}
+
+//
+// Sync a Directory -- Makes renames and new files durable
+//
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+//
+// Put -- Change the in-memory copy and append it to the Log
+//
+func (s *fileStorage) Put(p Page) error {
+	return s.commit(logRecord{Op: "put", Page: p})
+}
+
+//
+// Delete -- Change the in-memory copy and append it to the Log
+//
+func (s *fileStorage) Delete(name string) error {
+	return s.commit(logRecord{Op: "delete", Page: Page{Name: name}})
+}
+
+//
+// Apply a Batch -- Checked in full, then one Log record for all of it
+//
+func (s *fileStorage) Apply(ops []Op) error {
+	return s.commit(logRecord{Op: "batch", Batch: ops})
+}
+
+//
+// Close -- Stop the Checkpointer and the Reloader (every change is already in the Log)
+//
+func (s *fileStorage) Close() error {
+	close(s.done)
+	return s.syncs.stop() // Changes still waiting for -fsync interval
+}
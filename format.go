@@ -0,0 +1,244 @@
+// format - Versioned Data.db File Format and Migrations.
+// Data.db starts with a format Version. Older files are upgraded one
+// version at a time by the registered migrations when they are loaded.
+//
+//	Version 0 -- Bare JSON array of Pages without Index
+//	Version 1 -- Bare JSON array of Pages with Index
+//	Version 2 -- {"Version":2,"Pages":[...]}
+//	Version 3 -- Version 2 with a checksum (Sum) in every Page
+//	Version 4 -- Pages can carry revisions (Rev, Saved, History)
+//	Version 5 -- Pages carry a Version counter
+//	Version 6 -- Pages can carry an Expires time
+//	Version 7 -- Bodies can be stored compressed (Compressed)
+//	Version 8 -- Pages can carry a Deleted time (trash)
+//
+// The Header can also be stored in binary (gob) after binaryMagic. Bodies
+// are then kept as raw bytes instead of base64. The encoding is detected
+// when a file is read and chosen with -encoding when it is written.
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+const binaryMagic = "\x00DBDEMO\n" // Start of a binary Data.db -- Never valid JSON
+
+const formatVersion = 8 // Current Data.db format
+
+type dataHeader struct { // Data.db -- Format Version 2 and later
+	Version int    // Format Version
+	Pages   []Page // The Database
+}
+
+type newerFormatError struct { // Data.db written by a newer program
+	version int
+}
+
+func (e newerFormatError) Error() string {
+	return fmt.Sprintf("format version %d is newer than this program (%d)", e.version, formatVersion)
+}
+
+type migration func(data []byte) ([]byte, error) // Upgrades data by one Version
+
+var migrations = map[int]migration{ // Keyed by the Version they upgrade from
+	0: numberPages,
+	1: addHeader,
+	2: addSums,
+	3: setVersion(4),
+	4: setVersion(5),
+	5: setVersion(6),
+	6: setVersion(7),
+	7: setVersion(8),
+}
+
+//
+// Format Version of a Data.db file
+//
+func fileVersion(data []byte) (int, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		var h struct{ Version int }
+		if err := json.Unmarshal(data, &h); err != nil {
+			return 0, err
+		}
+		return h.Version, nil
+	}
+	var pages []map[string]json.RawMessage // Bare array -- Version 0 or 1
+	if err := json.Unmarshal(data, &pages); err != nil {
+		return 0, err
+	}
+	for _, p := range pages {
+		if _, ok := p["Index"]; !ok {
+			return 0, nil
+		}
+	}
+	return 1, nil
+}
+
+//
+// Upgrade data to the current format -- Returns the new data and the Version it had
+//
+func upgrade(data []byte) ([]byte, int, error) {
+	version, err := fileVersion(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version > formatVersion {
+		return nil, version, newerFormatError{version}
+	}
+	for v := version; v < formatVersion; v++ {
+		if data, err = migrations[v](data); err != nil {
+			return nil, version, fmt.Errorf("migration from version %d: %v", v, err)
+		}
+	}
+	return data, version, nil
+}
+
+//
+// Encode the Pages in the current format -- encoding is "json" or "binary"
+//
+// The result is sealed when a key is set (see crypt.go).
+//
+func encodeSnapshot(pages []Page, encoding string) ([]byte, error) {
+	h := dataHeader{Version: formatVersion, Pages: make([]Page, len(pages))}
+	for i, p := range pages {
+		p.Sum = pageSum(p)
+		h.Pages[i] = packPage(p)
+	}
+	switch encoding {
+	case "json":
+		data, err := json.Marshal(h)
+		if err != nil {
+			return nil, err
+		}
+		return sealFile(data)
+	case "binary":
+		buf := bytes.NewBufferString(binaryMagic)
+		if err := gob.NewEncoder(buf).Encode(h); err != nil {
+			return nil, err
+		}
+		return sealFile(buf.Bytes())
+	}
+	return nil, fmt.Errorf("unknown encoding %q", encoding)
+}
+
+//
+// Encoding of a Data.db file -- "binary" or "json"
+//
+func fileEncoding(data []byte) string {
+	if bytes.HasPrefix(data, []byte(binaryMagic)) {
+		return "binary"
+	}
+	return "json"
+}
+
+//
+// Decode a Data.db file of any Version and encoding
+//
+// A sealed file is opened first (see crypt.go). Every Page checksum is
+// verified and then cleared; a mismatch is an error.
+//
+func decodeSnapshot(data []byte) ([]Page, int, error) {
+	data, err := unsealFile(data, "snapshot")
+	if err != nil {
+		return nil, 0, err
+	}
+	if fileEncoding(data) == "binary" {
+		h, err := decodeBinary(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if h.Version == formatVersion {
+			return h.Pages, h.Version, checkSums(h.Pages)
+		}
+		if data, err = json.Marshal(h); err != nil { // Older Version -- Migrate as JSON
+			return nil, h.Version, err
+		}
+	}
+	data, version, err := upgrade(data)
+	if err != nil {
+		return nil, version, err
+	}
+	var h dataHeader
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, version, err
+	}
+	return h.Pages, version, checkSums(h.Pages)
+}
+
+//
+// Decode the Header of a binary Data.db file -- Any Version, Sums as stored
+//
+func decodeBinary(data []byte) (dataHeader, error) {
+	var h dataHeader
+	if err := gob.NewDecoder(bytes.NewReader(data[len(binaryMagic):])).Decode(&h); err != nil {
+		return h, err
+	}
+	for i := range h.Pages {
+		if h.Pages[i].Body == nil {
+			h.Pages[i].Body = []byte{} // gob does not keep empty Bodies
+		}
+	}
+	return h, nil
+}
+
+//
+// Migration 0 ==> 1 -- Number the Pages in file order
+//
+func numberPages(data []byte) ([]byte, error) {
+	var pages []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &pages); err != nil {
+		return nil, err
+	}
+	for i, p := range pages {
+		p["Index"] = json.RawMessage(fmt.Sprint(i))
+	}
+	return json.Marshal(pages)
+}
+
+//
+// Migration 1 ==> 2 -- Wrap the bare array in a Header
+//
+func addHeader(data []byte) ([]byte, error) {
+	return json.Marshal(struct {
+		Version int
+		Pages   json.RawMessage
+	}{2, bytes.TrimSpace(data)})
+}
+
+//
+// Migration 2 ==> 3 -- Checksum every Page
+//
+func addSums(data []byte) ([]byte, error) {
+	var h dataHeader
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, err
+	}
+	for i := range h.Pages {
+		h.Pages[i].Sum = pageSum(h.Pages[i])
+	}
+	h.Version = 3
+	return json.Marshal(h)
+}
+
+//
+// Migration that only changes the Version -- Pages without the new fields are valid as they are
+//
+// The new Version makes an older program refuse fields it would drop.
+//
+func setVersion(version int) migration {
+	return func(data []byte) ([]byte, error) {
+		var h struct {
+			Version int
+			Pages   json.RawMessage
+		}
+		if err := json.Unmarshal(data, &h); err != nil {
+			return nil, err
+		}
+		h.Version = version
+		return json.Marshal(h)
+	}
+}
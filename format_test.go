@@ -0,0 +1,150 @@
+// format_test - Test Suite for the db_demo File Format and Migrations.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// Test decodeSnapshot -- Every Version decodes to the same Pages
+//
+func TestMigrations(t *testing.T) {
+	current, err := encodeSnapshot(testData(), "json")
+	testCheck(err)
+	cases := []struct {
+		data    string
+		version int
+		want    []Page
+	}{
+		{cjj_db, 0, []Page{{Index: 0, Name: "Charles", Body: []byte("Charles Data")}, {Index: 1, Name: "Jack", Body: []byte("Jack Data")}, {Index: 2, Name: "Jacky", Body: []byte("Jacky Data")}}},
+		{cajmj_db, 1, testData()},
+		{null_db, 1, nil},
+		{string(current), formatVersion, testData()},
+	}
+	for _, c := range cases {
+		pages, version, err := decodeSnapshot([]byte(c.data))
+		if err != nil {
+			t.Errorf("%.30s: %v", c.data, err)
+			continue
+		}
+		if version != c.version {
+			t.Errorf("%.30s: Version = %d, Expected %d", c.data, version, c.version)
+		}
+		if !reflect.DeepEqual(pages, c.want) {
+			t.Errorf("%.30s:\n\tExpected:\t%v\n\tGot:\t%v", c.data, c.want, pages)
+		}
+	}
+
+	if _, _, err := decodeSnapshot([]byte("{\"Version\":99,\"Pages\":[]}")); err == nil {
+		t.Error("Newer format accepted")
+	}
+}
+
+//
+// Test loadDatabase -- Old files are upgraded in place with a backup kept
+//
+func TestUpgradeInPlace(t *testing.T) {
+	removeDatabase()
+	defer removeDatabase()
+	testCheck(ioutil.WriteFile(dataFile, []byte(cjj_db), 0644)) // Version 0
+
+	loadDatabase()
+	data, err := ioutil.ReadFile(dataFile)
+	testCheck(err)
+	if !strings.HasPrefix(string(data), fmt.Sprintf("{\"Version\":%d,", formatVersion)) {
+		t.Errorf("Data.db not upgraded: %.40s", data)
+	}
+	backup, err := ioutil.ReadFile(dataFile + ".v0.bak")
+	if err != nil || !bytes.Equal(backup, []byte(cjj_db)) {
+		t.Errorf("Backup = %q, %v", backup, err)
+	}
+	want := db.List()
+	loadDatabase() // Current format -- Loads as is
+	if !reflect.DeepEqual(db.List(), want) || len(want) != 3 {
+		t.Error("\nUpgraded = ", want, "\nReloaded = ", db.List())
+	}
+
+	// Newer format -- Refuse to start, never fall back to Data.db.prev
+	newer := []byte("{\"Version\":99,\"Pages\":[]}")
+	testCheck(ioutil.WriteFile(dataFile, newer, 0644))
+	defer func() {
+		if recover() == nil {
+			t.Error("loadDatabase accepted a newer format")
+		}
+		if data, _ := ioutil.ReadFile(dataFile); !bytes.Equal(data, newer) {
+			t.Errorf("Data.db changed: %q", data)
+		}
+	}()
+	loadDatabase()
+}
+
+//
+// Test the binary encoding -- Same Pages as JSON, no base64
+//
+func TestBinaryEncoding(t *testing.T) {
+	defer func(algo string) { *compressAlgo = algo }(*compressAlgo)
+	*compressAlgo = "none" // Compare the encodings alone
+	pages := testData()
+	pages = append(pages, Page{Index: 5, Name: "Henry", Body: []byte{}})
+	pages = append(pages, Page{Index: 6, Name: "Large", Body: bytes.Repeat([]byte{0, 1, 2, 250}, 3000)})
+	js, err := encodeSnapshot(pages, "json")
+	testCheck(err)
+	bin, err := encodeSnapshot(pages, "binary")
+	testCheck(err)
+
+	if fileEncoding(bin) != "binary" || fileEncoding(js) != "json" || fileEncoding([]byte(cajmj_db)) != "json" {
+		t.Error("Encoding not detected")
+	}
+	got, version, err := decodeSnapshot(bin)
+	if err != nil || version != formatVersion || !reflect.DeepEqual(got, pages) {
+		t.Errorf("Binary decode = %v, %d, %v", got, version, err)
+	}
+	if len(bin) >= len(js)*4/5 {
+		t.Errorf("Binary %d bytes, JSON %d bytes -- Expected at least 20%% smaller", len(bin), len(js))
+	}
+	if _, _, err := decodeSnapshot(bin[:len(bin)-5]); err == nil {
+		t.Error("Truncated binary file accepted")
+	}
+}
+
+//
+// Test convert -- Data.db and Data.log become one binary Data.db and back
+//
+func TestConvertCommand(t *testing.T) {
+	removeDatabase()
+	defer removeDatabase()
+	loadDatabase()
+	testRequest(editHandler, "GET", "/edit/Henry", "") // Still in Data.log
+	want := db.List()
+	db.Close()
+	db = nil
+
+	for _, to := range []string{"binary", "json"} {
+		if err := convertCommand([]string{"-to", to}); err != nil {
+			t.Fatal("convert: ", err)
+		}
+		data, err := ioutil.ReadFile(dataFile)
+		testCheck(err)
+		if fileEncoding(data) != to {
+			t.Errorf("Data.db is %s, Expected %s", fileEncoding(data), to)
+		}
+		loadDatabase() // Auto-detects the encoding
+		if !reflect.DeepEqual(db.List(), want) {
+			t.Error("\nConverted = ", db.List(), "\nExpected  = ", want)
+		}
+		db.Close()
+		db = nil
+	}
+
+	testCheck(convertCommand([]string{"-to", "binary", "-out", dataFile + ".v9.bak"}))
+	data, err := ioutil.ReadFile(dataFile + ".v9.bak")
+	testCheck(err)
+	if pages, _, err := decodeSnapshot(data); err != nil || !reflect.DeepEqual(pages, want) {
+		t.Error("\n-out copy = ", pages, err, "\nExpected  = ", want)
+	}
+}
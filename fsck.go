@@ -0,0 +1,215 @@
+// fsck - Page Checksums and the Data.db Consistency Check.
+// Every Page is stored with a CRC32 of its contents. The checksums
+// are verified whenever Data.db or Data.log is read; fsck goes through
+// Data.db record by record and can move bad records out of the way.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+type quarantineRecord struct { // One line of Data.db.quarantine
+	Record int             // Position in the damaged file
+	Reason string          // Why it was removed
+	Data   json.RawMessage // The record as it was stored
+}
+
+//
+// Checksum of a Page -- CRC32 of ID, Name and Body
+//
+// Index is left out: it is only the position and is rebuilt on load.
+// The Version, expiry, deletion and revisions are only added once a Page has them, so
+// Pages written before them keep their Sum.
+//
+func pageSum(p Page) uint32 {
+	h := crc32.NewIEEE()
+	h.Write([]byte(p.ID))
+	h.Write([]byte{0})
+	h.Write([]byte(p.Name))
+	h.Write([]byte{0})
+	h.Write(p.Body)
+	if p.Version != 0 {
+		fmt.Fprintf(h, "\x00v%d", p.Version)
+	}
+	if !p.Expires.IsZero() {
+		fmt.Fprintf(h, "\x00e%s", p.Expires.Format(time.RFC3339Nano))
+	}
+	if !p.Deleted.IsZero() {
+		fmt.Fprintf(h, "\x00d%s", p.Deleted.Format(time.RFC3339Nano))
+	}
+	if p.Rev != 0 || !p.Saved.IsZero() || len(p.History) > 0 {
+		fmt.Fprintf(h, "\x00%d %s", p.Rev, p.Saved.Format(time.RFC3339Nano))
+		for _, r := range p.History {
+			fmt.Fprintf(h, "\x00%d %s %d\x00", r.Rev, r.Saved.Format(time.RFC3339Nano), len(r.Body))
+			h.Write(r.Body)
+		}
+	}
+	return h.Sum32()
+}
+
+//
+// Expand the Bodies, verify the Page checksums, then clear them -- Sums only live on disk
+//
+func checkSums(pages []Page) error {
+	for i := range pages {
+		if err := unpackPage(&pages[i]); err != nil {
+			return fmt.Errorf("record %d: %v - run \"db_demo fsck\"", i, err)
+		}
+		if pages[i].Sum != pageSum(pages[i]) {
+			return fmt.Errorf("record %d (%q): checksum mismatch - run \"db_demo fsck\"", i, pages[i].Name)
+		}
+		pages[i].Sum = 0
+	}
+	return nil
+}
+
+//
+// Records of a Data.db file -- Each one still encoded, so a bad one can be set aside
+//
+func snapshotRecords(data []byte) ([]json.RawMessage, int, error) {
+	data, err := unsealFile(data, "snapshot")
+	if err != nil {
+		return nil, 0, err
+	}
+	if fileEncoding(data) == "binary" {
+		h, err := decodeBinary(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if data, err = json.Marshal(h); err != nil {
+			return nil, h.Version, err
+		}
+	}
+	data, version, err := upgrade(data)
+	if err != nil {
+		return nil, version, err
+	}
+	var h struct{ Pages []json.RawMessage }
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, version, err
+	}
+	return h.Pages, version, nil
+}
+
+//
+// Check file record by record -- Returns the number of problems found
+//
+// A record that does not decode, fails its checksum, has a blank Name or
+// repeats an earlier Name or ID is bad; an Index out of sequence is a
+// problem too. With repair, bad records are appended to file.quarantine,
+// the Log is replayed over the good ones and a new Snapshot is written with
+// the Index sequence rebuilt. The damaged file is kept as file.prev.
+//
+func fsck(file string, repair bool, w io.Writer) (int, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	plain, err := unsealFile(data, file)
+	if err != nil {
+		return 0, err // Wrong or missing key -- Not damage
+	}
+	records, version, err := snapshotRecords(plain)
+	if err != nil {
+		return 0, fmt.Errorf("%s cannot be read at all (%v) - try %s.prev", file, err, file)
+	}
+	fmt.Fprintf(w, "%s: format %d, %s, %d records\n", file, version, fileEncoding(plain), len(records))
+
+	var good []Page
+	var bad []quarantineRecord
+	names := map[string]int{} // Name ==> record it was first seen in
+	ids := map[string]int{}   // ID ==> record it was first seen in
+	problems := 0
+	for i, raw := range records {
+		var p Page
+		reason := ""
+		if err := json.Unmarshal(raw, &p); err != nil {
+			reason = fmt.Sprint("cannot be decoded: ", err)
+		} else if err := unpackPage(&p); err != nil {
+			reason = fmt.Sprint("cannot be expanded: ", err)
+		} else if p.Sum != pageSum(p) {
+			reason = fmt.Sprintf("checksum mismatch (stored %08x, computed %08x)", p.Sum, pageSum(p))
+		} else if len(p.Name) <= 0 {
+			reason = "blank Name"
+		} else if first, ok := names[p.Name]; ok {
+			reason = fmt.Sprintf("duplicate Name (first in record %d)", first)
+		} else if first, ok := ids[p.ID]; ok && len(p.ID) > 0 {
+			reason = fmt.Sprintf("duplicate ID %s (first in record %d)", p.ID, first)
+		}
+		if len(reason) > 0 {
+			fmt.Fprintf(w, "record %d (%q): %s\n", i, p.Name, reason)
+			bad = append(bad, quarantineRecord{Record: i, Reason: reason, Data: raw})
+			problems++
+			continue
+		}
+		if p.Index != i { // Renumbered on repair anyway
+			fmt.Fprintf(w, "record %d (%q): Index %d, expected %d\n", i, p.Name, p.Index, i)
+			problems++
+		}
+		names[p.Name] = i
+		ids[p.ID] = i
+		p.Sum = 0
+		good = append(good, p)
+	}
+
+	switch {
+	case problems == 0:
+		fmt.Fprintln(w, "No problems found")
+		return 0, nil
+	case !repair:
+		fmt.Fprintf(w, "%d problems found - run \"db_demo fsck -repair\" to quarantine %d bad records and rebuild the Index\n", problems, len(bad))
+		return problems, nil
+	}
+
+	if len(bad) > 0 {
+		if err := quarantine(file+".quarantine", bad); err != nil {
+			return problems, err
+		}
+	}
+	s := newFileStorage(file, fileEncoding(plain))
+	s.reset(good) // Renumbers the Index
+	s.snapshotSum = crc32.ChecksumIEEE(data)
+	if err := s.replayLog(); err != nil { // Changes made since the damaged Snapshot
+		return problems, err
+	}
+	if err := s.checkpoint(); err != nil {
+		return problems, err
+	}
+	fmt.Fprintf(w, "Repaired: %d records kept, %d quarantined in %s, damaged file kept as %s\n",
+		len(good), len(bad), file+".quarantine", s.prev)
+	return problems, nil
+}
+
+//
+// Append bad records to the Quarantine file -- One JSON record per line
+//
+func quarantine(file string, bad []quarantineRecord) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	for _, q := range bad {
+		line, err := json.Marshal(q)
+		if err == nil {
+			line, err = sealLine(line) // Never leak what Data.db sealed
+		}
+		if err == nil {
+			_, err = f.Write(append(line, '\n'))
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
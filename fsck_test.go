@@ -0,0 +1,111 @@
+// fsck_test - Test Suite for the db_demo Checksums and fsck.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// Write Data.db with a damaged record, a duplicate Name and an Index out of sequence
+//
+func writeDamagedDatabase() {
+	pages := testData()
+	for i := range pages {
+		pages[i].ID = newID()
+	}
+	data, err := encodeSnapshot(pages, "json")
+	testCheck(err)
+	var h dataHeader
+	testCheck(json.Unmarshal(data, &h))
+	h.Pages[1].Body = []byte("Ann Dat@") // Bit rot -- Sum no longer matches
+	h.Pages[3].Name = "Charles"          // Duplicate Name
+	h.Pages[3].Sum = pageSum(h.Pages[3]) // ... with a good checksum
+	h.Pages[4].Index = 9                 // Out of sequence
+	data, err = json.Marshal(h)
+	testCheck(err)
+	testCheck(ioutil.WriteFile(dataFile, data, 0644))
+}
+
+//
+// Test checksums on load -- A damaged record is never loaded
+//
+func TestChecksumOnLoad(t *testing.T) {
+	removeDatabase()
+	defer removeDatabase()
+	writeDamagedDatabase()
+
+	_, err := openFileStorage(dataFile, "json")
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") || !strings.Contains(err.Error(), "fsck") {
+		t.Error("Damaged Data.db loaded: ", err)
+	}
+
+	removeDatabase()
+	loadDatabase()
+	testRequest(editHandler, "GET", "/edit/Henry", "") // Put in Data.log with a Sum
+	log, err := ioutil.ReadFile("Data.log")
+	testCheck(err)
+	damaged := bytes.Replace(log, []byte("\"Name\":\"Henry\""), []byte("\"Name\":\"Henri\""), 1)
+	db.Close()
+	db = nil
+	testCheck(ioutil.WriteFile("Data.log", damaged, 0644))
+	if _, err := openFileStorage(dataFile, "json"); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Error("Damaged Data.log replayed: ", err)
+	}
+}
+
+//
+// Test fsck -- Reports without changing anything, repairs with -repair
+//
+func TestFsck(t *testing.T) {
+	removeDatabase()
+	defer removeDatabase()
+	writeDamagedDatabase()
+	before, err := ioutil.ReadFile(dataFile)
+	testCheck(err)
+
+	var out bytes.Buffer
+	problems, err := fsck(dataFile, false, &out)
+	if err != nil || problems != 3 {
+		t.Errorf("fsck = %d, %v; Expected 3 problems\n%s", problems, err, out.String())
+	}
+	for _, want := range []string{"record 1 (\"Ann\"): checksum mismatch", "record 3 (\"Charles\"): duplicate Name", "record 4 (\"Jacky\"): Index 9, expected 4"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Report is missing %q:\n%s", want, out.String())
+		}
+	}
+	if after, _ := ioutil.ReadFile(dataFile); !bytes.Equal(after, before) {
+		t.Error("fsck without -repair changed Data.db")
+	}
+	if fsckCommand([]string{}) == nil {
+		t.Error("fsck command reported success")
+	}
+
+	out.Reset()
+	if _, err := fsck(dataFile, true, &out); err != nil {
+		t.Fatal("fsck -repair: ", err)
+	}
+	quarantined, err := ioutil.ReadFile(dataFile + ".quarantine")
+	testCheck(err)
+	lines := strings.Split(strings.TrimSpace(string(quarantined)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "\"Record\":1,") || !strings.Contains(lines[1], "\"Record\":3,") {
+		t.Errorf("Quarantine = %s", quarantined)
+	}
+	if prev, _ := ioutil.ReadFile(dataFile + ".prev"); !bytes.Equal(prev, before) {
+		t.Error("Damaged file not kept as Data.db.prev")
+	}
+
+	loadDatabase()
+	want := []Page{{Index: 0, Name: "Charles", Body: []byte("Charles Data")}, {Index: 1, Name: "Jack", Body: []byte("Jack Data")}, {Index: 2, Name: "Jacky", Body: []byte("Jacky Data")}}
+	if got := pageContents(db.List()); !reflect.DeepEqual(got, want) {
+		t.Error("\nRepaired = ", got, "\nExpected = ", want)
+	}
+	out.Reset()
+	if problems, err := fsck(dataFile, false, &out); err != nil || problems != 0 {
+		t.Errorf("fsck after repair = %d, %v\n%s", problems, err, out.String())
+	}
+}
@@ -0,0 +1,163 @@
+// fsync - Durability Policy and Group Commit.
+// -fsync picks when committed changes are flushed to disk:
+//
+//	always   -- Before the Client gets an answer (the default). A commit that
+//	            arrives while a flush runs waits for the next one, so a burst
+//	            of saves shares one fsync instead of one each.
+//	interval -- Once a second in the background. A crash can lose the last second.
+//	none     -- Left to the OS.
+//
+// The File and Disk Storage hand every write to a syncer and wait on it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var fsyncPolicy = flag.String("fsync", "always", "When changes are flushed to disk: always, interval (once a second) or none (left to the OS)")
+
+const fsyncInterval = time.Second // How often -fsync interval flushes
+
+type syncer struct { // Group Commit -- One fsync for every write waiting on it
+	mu       sync.Mutex
+	flushed  *sync.Cond   // Broadcast when a flush ends
+	policy   string       // "always", "interval" or "none"
+	sync     func() error // Flushes every write handed in so far
+	written  int64        // Writes handed in
+	synced   int64        // Writes known to be on disk
+	flushing bool         // A flush is running -- Others wait for it
+	flushes  int64        // fsyncs done
+	err      error        // First failed flush -- Reported to every later commit
+	done     chan bool    // Stops the interval flusher
+}
+
+//
+// New syncer flushing with fsync under policy -- Checked by start
+//
+func newSyncer(policy string, fsync func() error) *syncer {
+	y := &syncer{policy: policy, sync: fsync, done: make(chan bool)}
+	y.flushed = sync.NewCond(&y.mu)
+	return y
+}
+
+//
+// Start -- Check the policy, start the interval flusher
+//
+func (y *syncer) start() error {
+	switch y.policy {
+	case "always", "none":
+	case "interval":
+		go y.flusher(fsyncInterval)
+	default:
+		return fmt.Errorf("unknown fsync policy %q (always, interval or none)", y.policy)
+	}
+	return nil
+}
+
+//
+// Wrote -- Hand in a write, returns its sequence number for wait
+//
+// Called with the Storage's writer lock held, so the sequence follows the
+// order of the writes.
+//
+func (y *syncer) wrote() int64 {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	y.written++
+	return y.written
+}
+
+//
+// Wait -- Until write seq is on disk, as the policy asks
+//
+func (y *syncer) wait(seq int64) error {
+	if y.policy != "always" {
+		return nil
+	}
+	return y.flushTo(seq)
+}
+
+//
+// Flush -- Every write handed in so far
+//
+func (y *syncer) flush() error {
+	y.mu.Lock()
+	seq := y.written
+	y.mu.Unlock()
+	return y.flushTo(seq)
+}
+
+//
+// Flush to seq -- Join the flush that is running or start the next one
+//
+// A failed fsync leaves it unknown what reached the disk, so the error
+// sticks and every later commit reports it.
+//
+func (y *syncer) flushTo(seq int64) error {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	for y.synced < seq && y.err == nil {
+		if y.flushing {
+			y.flushed.Wait() // Might not cover seq -- Checked again
+			continue
+		}
+		y.flushing = true
+		target := y.written // Everything written so far rides along
+		y.mu.Unlock()
+		err := y.sync()
+		y.mu.Lock()
+		y.flushing = false
+		y.flushes++
+		if err != nil {
+			y.err = err
+		} else {
+			y.synced = target
+		}
+		y.flushed.Broadcast()
+	}
+	return y.err
+}
+
+//
+// Flusher -- Flush every interval while there are writes (-fsync interval)
+//
+func (y *syncer) flusher(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-y.done:
+			return
+		case <-tick.C:
+		}
+		if err := y.flush(); err != nil {
+			fmt.Println("Flush Failed:", err)
+			return
+		}
+	}
+}
+
+//
+// Stop -- Stop the flusher and flush what is left (unless -fsync none)
+//
+func (y *syncer) stop() error {
+	if y.policy == "interval" {
+		close(y.done)
+	}
+	if y.policy == "none" {
+		return nil
+	}
+	return y.flush()
+}
+
+//
+// Stats -- fsyncs done and writes handed in
+//
+func (y *syncer) stats() (flushes, writes int64) {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	return y.flushes, y.written
+}
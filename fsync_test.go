@@ -0,0 +1,118 @@
+// fsync_test - Test Suite for the db_demo Durability Policy and Group Commit.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+// Test Group Commit -- A burst of writers shares the fsyncs
+//
+func TestGroupCommit(t *testing.T) {
+	y := newSyncer("always", func() error {
+		time.Sleep(10 * time.Millisecond) // A slow disk
+		return nil
+	})
+	testCheck(y.start())
+
+	const writers = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- y.wait(y.wrote())
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		testCheck(err)
+	}
+	flushes, writes := y.stats()
+	if writes != writers || flushes >= writers || y.synced != writers {
+		t.Errorf("%d writes, %d fsyncs, %d synced; Expected fewer fsyncs than writes", writes, flushes, y.synced)
+	}
+	testCheck(y.stop())
+}
+
+//
+// Test the -fsync policies -- When a write is flushed
+//
+func TestFsyncPolicy(t *testing.T) {
+	cases := []struct {
+		policy  string
+		waited  int64 // fsyncs after three writes waited on
+		stopped int64 // fsyncs after stop
+	}{
+		{"always", 3, 3},
+		{"interval", 0, 1},
+		{"none", 0, 0},
+	}
+	for _, c := range cases {
+		n := int64(0)
+		y := newSyncer(c.policy, func() error { n++; return nil })
+		testCheck(y.start())
+		for i := 0; i < 3; i++ {
+			testCheck(y.wait(y.wrote()))
+		}
+		waited := n
+		testCheck(y.stop())
+		if waited != c.waited || n != c.stopped {
+			t.Errorf("%s: %d fsyncs after the writes, %d after stop; Expected %d, %d", c.policy, waited, n, c.waited, c.stopped)
+		}
+	}
+	if err := newSyncer("sometimes", nil).start(); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+//
+// Test a failed fsync -- Reported to the writer and every later one
+//
+func TestFsyncError(t *testing.T) {
+	failed := errors.New("disk gone")
+	y := newSyncer("always", func() error { return failed })
+	testCheck(y.start())
+	for i := 0; i < 2; i++ {
+		if err := y.wait(y.wrote()); err != failed {
+			t.Errorf("write %d: wait = %v", i, err)
+		}
+	}
+}
+
+//
+// Test concurrent saves under each policy -- Every one lands and replays
+//
+func TestFsyncStorage(t *testing.T) {
+	defer func(kind, policy string) { *storageKind, *fsyncPolicy = kind, policy }(*storageKind, *fsyncPolicy)
+	for _, kind := range []string{"file", "disk"} {
+		for _, policy := range []string{"always", "interval", "none"} {
+			removeDatabase()
+			*storageKind, *fsyncPolicy = kind, policy
+			loadDatabase()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					testCheck(db.Put(Page{Name: fmt.Sprint("Page ", i), Body: []byte("Data")}))
+				}(i)
+			}
+			wg.Wait()
+			before := db.List()
+			loadDatabase() // Close flushes what is left
+			if got := db.List(); len(got) != 25 || !reflect.DeepEqual(got, before) {
+				t.Errorf("%s, -fsync %s: %d Pages after reload, Expected 25", kind, policy, len(got))
+			}
+		}
+	}
+	removeDatabase()
+}
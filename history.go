@@ -0,0 +1,321 @@
+// history - Page Revisions and Time-Travel Reads.
+// Every save keeps the Body it replaces in Page.History, numbered and
+// timestamped, so a Page can be viewed as it was at a revision or a time
+// and rolled back. Old revisions are dropped on save by the -revisions
+// and -revision-age limits.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var maxRevisions = flag.Int("revisions", 20, "Earlier revisions kept per Page (0 keeps all)")
+var maxRevisionAge = flag.Duration("revision-age", 0, "Drop revisions saved longer ago than this (0 keeps them)")
+
+type Revision struct { // Earlier Body of a Page
+	Rev        int       // Revision number
+	Saved      time.Time // When this Body was saved -- Zero if before revisions
+	Body       []byte    // The Body as saved
+	Compressed string    `json:",omitempty"` // How Body is compressed on disk -- Empty in memory
+}
+
+//
+// Current time as stored -- UTC without the monotonic clock, so it survives Data.db unchanged
+//
+func now() time.Time {
+	return time.Now().UTC().Round(0)
+}
+
+//
+// Revisions of a Page -- Oldest first, the current Body last
+//
+func (p Page) revisions() []Revision {
+	return append(append([]Revision{}, p.History...), Revision{Rev: p.Rev, Saved: p.Saved, Body: p.Body})
+}
+
+//
+// Revision number rev of a Page
+//
+func (p Page) revision(rev int) (Revision, bool) {
+	for _, r := range p.revisions() {
+		if r.Rev == rev {
+			return r, true
+		}
+	}
+	return Revision{}, false
+}
+
+//
+// Revision of a Page current at time t -- The last one saved at or before t
+//
+func (p Page) revisionAt(t time.Time) (Revision, bool) {
+	var found Revision
+	ok := false
+	for _, r := range p.revisions() {
+		if r.Saved.After(t) {
+			break
+		}
+		found, ok = r, true
+	}
+	return found, ok
+}
+
+//
+// Prune History to the -revisions and -revision-age limits -- Oldest go first
+//
+func pruneHistory(history []Revision, t time.Time) []Revision {
+	for len(history) > 0 {
+		tooMany := *maxRevisions > 0 && len(history) > *maxRevisions
+		tooOld := *maxRevisionAge > 0 && t.Sub(history[0].Saved) > *maxRevisionAge
+		if !tooMany && !tooOld {
+			break
+		}
+		history = history[1:]
+	}
+	return history
+}
+
+//
+// Next revision of a stored Page -- The old Body moves into History
+//
+// Returns false when body is unchanged; there is nothing to keep then.
+//
+func nextRevision(old Page, body []byte) (Page, bool) {
+	if bytes.Equal(old.Body, body) {
+		return old, false
+	}
+	np := Page{ID: old.ID, Name: old.Name, Body: body, Rev: old.Rev + 1, Saved: now()}
+	history := append([]Revision{}, old.History...) // Never append into the stored Page
+	history = append(history, Revision{Rev: old.Rev, Saved: old.Saved, Body: old.Body})
+	np.History = pruneHistory(history, np.Saved)
+	return np, true
+}
+
+//
+// Logged form of a Page -- Its History without the revisions the stored Page has
+//
+// A save keeps the Body it replaces as one more revision, so its History
+// is the last few of the stored revisions and one new one. Only the new
+// one is logged, with how many of the stored ones come before it (kept);
+// the whole History would make every save as large as all its revisions.
+// A History that does not go on from the stored one is logged whole.
+//
+func historyDelta(stored []Revision, p Page) (Page, int) {
+	if len(p.History) == 0 {
+		return p, 0
+	}
+	for i, r := range stored {
+		if r.Rev != p.History[0].Rev {
+			continue
+		}
+		kept := len(stored) - i
+		if kept > len(p.History) || !sameRevisions(stored[i:], p.History[:kept]) {
+			return p, 0
+		}
+		p.History = p.History[kept:]
+		return p, kept
+	}
+	return p, 0
+}
+
+//
+// Same revisions -- Every revision of a, in order, at the start of b
+//
+func sameRevisions(a, b []Revision) bool {
+	for i := range a {
+		if a[i].Rev != b[i].Rev || !a[i].Saved.Equal(b[i].Saved) || !bytes.Equal(a[i].Body, b[i].Body) {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// History of a logged Page -- The last kept stored revisions, then the logged ones
+//
+func historyKept(stored []Revision, kept int, logged []Revision) ([]Revision, error) {
+	if kept == 0 {
+		return logged, nil
+	}
+	if kept > len(stored) {
+		return nil, fmt.Errorf("record keeps %d revisions, the Page has %d", kept, len(stored))
+	}
+	return append(append([]Revision{}, stored[len(stored)-kept:]...), logged...), nil
+}
+
+//
+// Puts of a Batch logged without the stored revisions -- No earlier Operation touches their Name
+//
+func deltaPuts(ops []Op) []bool {
+	ok := make([]bool, len(ops))
+	touched := map[string]bool{}
+	for i, op := range ops {
+		ok[i] = op.Op == "put" && !touched[op.Page.Name]
+		touched[op.Page.Name] = true
+		touched[op.Name] = true
+		touched[op.NewName] = true
+	}
+	return ok
+}
+
+//
+// Logged form of a record -- Every put with only the revisions it adds
+//
+// stored gives the revisions of the Page stored under a Name (none if there is no such Page).
+//
+func logForm(rec logRecord, stored func(name string) ([]Revision, error)) (logRecord, error) {
+	switch rec.Op {
+	case "put":
+		history, err := stored(rec.Page.Name)
+		if err != nil {
+			return rec, err
+		}
+		rec.Page, rec.Kept = historyDelta(history, rec.Page)
+	case "batch":
+		rec.Batch = append([]Op(nil), rec.Batch...) // Never change the caller's Operations
+		for i, ok := range deltaPuts(rec.Batch) {
+			if !ok {
+				continue
+			}
+			history, err := stored(rec.Batch[i].Page.Name)
+			if err != nil {
+				return rec, err
+			}
+			rec.Batch[i].Page, rec.Batch[i].Kept = historyDelta(history, rec.Batch[i].Page)
+		}
+	}
+	return rec, nil
+}
+
+//
+// Prune every History to the revision limits -- A Checkpoint drops what retention let go
+//
+func (s *memStorage) pruneHistories(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.pages {
+		s.pages[i].History = pruneHistory(s.pages[i].History, t)
+	}
+}
+
+//
+// Revision requested by a URL -- ?rev=N or ?at=RFC3339 time
+//
+// msg explains a bad request or a revision that is gone; ask is false
+// when neither was requested.
+//
+func requestedRevision(r *http.Request, p Page) (rev Revision, ask bool, msg string) {
+	if s := r.FormValue("rev"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return rev, true, "Bad revision number!"
+		}
+		if found, ok := p.revision(n); ok {
+			return found, true, ""
+		}
+		return rev, true, "Revision not found!"
+	}
+	if s := r.FormValue("at"); len(s) > 0 {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return rev, true, "Bad time - use RFC 3339 (2006-01-02T15:04:05Z)"
+		}
+		if found, ok := p.revisionAt(t); ok {
+			return found, true, ""
+		}
+		return rev, true, "No revision at that time!"
+	}
+	return rev, false, ""
+}
+
+//
+// History Handler --
+//
+// localhost:8080/history/name  -- Lists the revisions of "name"
+//
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len("/history/"):]
+	p, ok := findName(db, name)
+	if !ok {
+		fmt.Fprintf(w, "<h1>History: %s</h1>", "Name not found!")
+		return
+	}
+	var body string
+	for _, rev := range p.revisions() {
+		saved := "before revisions"
+		if !rev.Saved.IsZero() {
+			saved = rev.Saved.Format(time.RFC3339)
+		}
+		body += fmt.Sprintln("Revision ", rev.Rev, ": ", saved, " ", len(rev.Body), "bytes")
+	}
+	fmt.Fprintf(w, "<h1>History: %s</h1>"+
+		"<textarea nameM=\"body\" rows=\"20\" cols=\"80\">%s</textarea><br>"+
+		"View one with /view/%s?rev=N or ?at=TIME, restore it with /rollback/%s?rev=N",
+		p.Name, body, p.Name, p.Name)
+}
+
+//
+// Rollback Handler --
+//
+// localhost:8080/rollback/name?rev=N       -- Asks first: a form to confirm
+// POST localhost:8080/rollback/name?rev=N  -- version=... Saves revision N as the current Body
+//
+// The Body it replaces is kept as a revision, so a rollback can be undone.
+// The form carries the Version it was shown for; a Page saved since is
+// not rolled back (409 Conflict) and the form is shown again.
+//
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "<h1>Rollback: %s</h1>", "GET asks, POST rolls back")
+		return
+	}
+	name := r.URL.Path[len("/rollback/"):]
+	p, ok := findName(db, name)
+	if !ok {
+		fmt.Fprintf(w, "<h1>Rollback: %s</h1>", "Name not found!")
+		return
+	}
+	rev, ask, msg := requestedRevision(r, p)
+	if !ask {
+		msg = "Which revision? Add ?rev=N"
+	}
+	if len(msg) > 0 {
+		fmt.Fprintf(w, "<h1>Rollback: %s</h1>", msg)
+		return
+	}
+	if r.Method != "POST" {
+		writeRollbackConfirm(w, p, rev)
+		return
+	}
+	version, _ := expectedVersion(r, p)
+	np := &Page{ID: p.ID, Name: p.Name, Body: rev.Body, Version: version, Expires: p.Expires}
+	err := np.save()
+	if err == errConflict { // Saved since the form was shown -- Ask again
+		current, _ := findName(db, name)
+		w.WriteHeader(http.StatusConflict)
+		writeRollbackConfirm(w, current, rev)
+		return
+	}
+	check("Save Failed", err)
+	http.Redirect(w, r, "/view/"+p.Name, http.StatusFound)
+}
+
+//
+// Rollback confirmation -- A form that POSTs the rollback for the Version of p shown
+//
+func writeRollbackConfirm(w http.ResponseWriter, p Page, rev Revision) {
+	fmt.Fprintf(w, "<h1>Rollback: '%s' to revision %d of %d</h1>"+
+		"<form action=\"/rollback/%s?rev=%d\" method=\"POST\">"+
+		"<input type=\"hidden\" name=\"version\" value=\"%d\">"+
+		"<input type=\"submit\" value=\"Roll back\">"+
+		"</form>"+
+		"The current Body is kept as a revision. <a href=\"/view/%s?rev=%d\">View revision %d</a>",
+		p.Name, rev.Rev, p.Rev, p.Name, rev.Rev, p.Version, p.Name, rev.Rev, rev.Rev)
+}
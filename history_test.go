@@ -0,0 +1,257 @@
+// history_test - Test Suite for the db_demo Page Revisions.
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Revision numbers of a Page's History
+//
+func historyRevs(p Page) []int {
+	var revs []int
+	for _, r := range p.History {
+		revs = append(revs, r.Rev)
+	}
+	return revs
+}
+
+//
+// Test save, /view/?rev= and /rollback/ -- Every save keeps the Body it replaces
+//
+func TestRevisions(t *testing.T) {
+	testDatabase([]byte(cajmj_db))
+	testRequest(saveHandler, "POST", "/save/Ann", "body=one")
+	testRequest(saveHandler, "POST", "/save/Ann", "body=two")
+	testRequest(saveHandler, "POST", "/save/Ann", "body=two") // Unchanged -- No revision
+
+	p, _ := db.Get("Ann")
+	if string(p.Body) != "two" || p.Rev != 2 || !reflect.DeepEqual(historyRevs(p), []int{0, 1}) {
+		t.Errorf("After saves: Body %q, Rev %d, History %v", p.Body, p.Rev, historyRevs(p))
+	}
+	if p.History[1].Saved.IsZero() || p.Saved.Before(p.History[1].Saved) {
+		t.Errorf("Saved times out of order: %v, %v", p.History[1].Saved, p.Saved)
+	}
+
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{"/view/Ann", "two"},
+		{"/view/Ann?rev=0", "Ann (revision 0)"},
+		{"/view/Ann?rev=0", "Ann Data"},
+		{"/view/Ann?rev=1", "one"},
+		{"/view/Ann?rev=7", "Revision not found!"},
+		{"/view/Ann?rev=x", "Bad revision number!"},
+		{"/view/Ann?at=yesterday", "Bad time"},
+		{"/history/Ann", "before revisions"},
+		{"/history/Henry", "Name not found!"},
+		{"/rollback/Ann", "Which revision?"},
+	}
+	for _, c := range cases {
+		h := viewHandler
+		if strings.HasPrefix(c.url, "/history/") {
+			h = historyHandler
+		} else if strings.HasPrefix(c.url, "/rollback/") {
+			h = rollbackHandler
+		}
+		if got := testRequest(h, "GET", c.url, "").Body.String(); !strings.Contains(got, c.want) {
+			t.Errorf("%s = %q\n\tExpected it to contain %q", c.url, got, c.want)
+		}
+	}
+
+	w := testRequest(rollbackHandler, "GET", "/rollback/Ann?rev=0", "") // Only asks
+	confirm := fmt.Sprintf("<form action=\"/rollback/Ann?rev=0\" method=\"POST\"><input type=\"hidden\" name=\"version\" value=\"%d\">", p.Version)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), confirm) {
+		t.Errorf("GET rollback = %d %q\n\tExpected 200 with %q", w.Code, w.Body.String(), confirm)
+	}
+	if w := testRequest(rollbackHandler, "PUT", "/rollback/Ann?rev=0", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT rollback = %d %q", w.Code, w.Body.String())
+	}
+	if q, _ := db.Get("Ann"); string(q.Body) != "two" || q.Version != p.Version {
+		t.Errorf("Rolled back without a POST: Body %q, Version %d", q.Body, q.Version)
+	}
+	if w := testRequest(rollbackHandler, "POST", "/rollback/Ann?rev=0", fmt.Sprint("version=", p.Version-1)); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), confirm) {
+		t.Errorf("Stale rollback = %d %q\n\tExpected 409 with %q", w.Code, w.Body.String(), confirm)
+	}
+
+	testRequest(rollbackHandler, "POST", "/rollback/Ann?rev=0", fmt.Sprint("version=", p.Version))
+	p, _ = db.Get("Ann")
+	if string(p.Body) != "Ann Data" || p.Rev != 3 || !reflect.DeepEqual(historyRevs(p), []int{0, 1, 2}) {
+		t.Errorf("After rollback: Body %q, Rev %d, History %v", p.Body, p.Rev, historyRevs(p))
+	}
+}
+
+//
+// Test ?at= -- The revision current at a time
+//
+func TestRevisionAt(t *testing.T) {
+	t1 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	t3 := t2.Add(time.Hour)
+	testDatabase([]byte(c_db))
+	testCheck(db.Put(Page{Name: "Clock", Body: []byte("three"), Rev: 3, Saved: t3,
+		History: []Revision{{Rev: 1, Saved: t1, Body: []byte("one")}, {Rev: 2, Saved: t2, Body: []byte("two")}}}))
+
+	cases := []struct {
+		at   time.Time
+		want string
+	}{
+		{t1.Add(-time.Second), "No revision at that time!"},
+		{t1, "one"},
+		{t1.Add(30 * time.Minute), "one"},
+		{t2, "two"},
+		{t3.Add(time.Minute), "three"},
+	}
+	for _, c := range cases {
+		url := "/view/Clock?at=" + c.at.Format(time.RFC3339)
+		if got := testRequest(viewHandler, "GET", url, "").Body.String(); !strings.Contains(got, c.want) {
+			t.Errorf("%s = %q\n\tExpected it to contain %q", url, got, c.want)
+		}
+	}
+}
+
+//
+// Test retention -- -revisions and -revision-age drop the oldest revisions
+//
+func TestRevisionRetention(t *testing.T) {
+	defer func(n int, age time.Duration) { *maxRevisions, *maxRevisionAge = n, age }(*maxRevisions, *maxRevisionAge)
+	*maxRevisions, *maxRevisionAge = 2, 0
+
+	testDatabase([]byte(c_db))
+	for _, body := range []string{"a", "b", "c", "d", "e"} {
+		testRequest(saveHandler, "POST", "/save/Charles", "body="+body)
+	}
+	p, _ := db.Get("Charles")
+	if !reflect.DeepEqual(historyRevs(p), []int{3, 4}) || string(p.History[0].Body) != "c" {
+		t.Errorf("-revisions 2: History %v", historyRevs(p))
+	}
+
+	*maxRevisions, *maxRevisionAge = 0, 24*time.Hour
+	day := time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC)
+	history := []Revision{{Rev: 1, Saved: day.Add(-72 * time.Hour)}, {Rev: 2, Saved: day.Add(-25 * time.Hour)}, {Rev: 3, Saved: day.Add(-time.Hour)}}
+	if got := pruneHistory(history, day); !reflect.DeepEqual(historyRevs(Page{History: got}), []int{3}) {
+		t.Errorf("-revision-age 24h: History %v", historyRevs(Page{History: got}))
+	}
+}
+
+//
+// Test revisions on disk -- Replayed from the Log and reloaded from a Snapshot exactly as saved
+//
+func TestRevisionsPersist(t *testing.T) {
+	freshDatabase()
+	defer removeDatabase()
+	testRequest(saveHandler, "POST", "/save/Mike", "body=Mike v1")
+	testRequest(saveHandler, "POST", "/save/Mike", "body=Mike v2")
+	want, _ := db.Get("Mike")
+
+	for _, from := range []string{"Data.log", "Data.db"} {
+		loadDatabase()
+		if got, _ := db.Get("Mike"); !reflect.DeepEqual(got, want) {
+			t.Error(from, "\nReloaded = ", got, "\nSaved    = ", want)
+		}
+		testCheck(db.(*fileStorage).checkpoint())
+	}
+}
+
+//
+// Test the Log of a save -- Only the revision it adds, whatever the History holds
+//
+func TestRevisionsLogged(t *testing.T) {
+	defer func(kind string, n int) { *storageKind, *maxRevisions = kind, n }(*storageKind, *maxRevisions)
+	defer removeDatabase()
+	*maxRevisions = 20
+	body := func(i int) string { // Random letters -- Much the same size compressed or not
+		rnd := rand.New(rand.NewSource(int64(i)))
+		b := make([]byte, 10000)
+		for j := range b {
+			b[j] = byte('a' + rnd.Intn(26))
+		}
+		return string(b)
+	}
+	size := func(file string) int64 {
+		info, err := os.Stat(file)
+		testCheck(err)
+		return info.Size()
+	}
+	for _, c := range []struct{ kind, file string }{{"file", "Data.log"}, {"disk", pagesFile}} {
+		removeDatabase()
+		*storageKind = c.kind
+		loadDatabase()
+		for i := 0; i < 25; i++ {
+			testRequest(saveHandler, "POST", "/save/Ann", "body="+body(i))
+		}
+		saves := []struct {
+			how  string
+			save func()
+		}{
+			{"save", func() { testRequest(saveHandler, "POST", "/save/Ann", "body="+body(25)) }},
+			{"batch", func() {
+				testRequest(batchHandler, "POST", "/batch/", "[{\"Op\":\"put\",\"Name\":\"Ann\",\"Body\":\""+body(26)+"\"}]")
+			}},
+		}
+		for _, s := range saves {
+			before := size(c.file)
+			s.save()
+			if grew := size(c.file) - before; grew > 3*10000 { // Body and one revision, base64 -- Not all 20
+				t.Errorf("%s: %s wrote %d bytes to %s", c.kind, s.how, grew, c.file)
+			}
+		}
+		want := db.List()
+		if ann, _ := db.Get("Ann"); len(ann.History) != 20 {
+			t.Fatalf("%s: %d revisions, Expected 20", c.kind, len(ann.History))
+		}
+		loadDatabase() // Replay -- Data.log, or Data.pages through its index
+		if !reflect.DeepEqual(db.List(), want) {
+			t.Errorf("%s: History not replayed", c.kind)
+		}
+		if c.kind == "disk" {
+			testCheck(db.Close())
+			testCheck(os.Remove(pagesFile + ".idx"))
+			s, err := openDiskStorage(pagesFile, 1<<20) // Every record read again
+			testCheck(err)
+			db = s
+			if !reflect.DeepEqual(db.List(), want) {
+				t.Errorf("%s: History not replayed without the index", c.kind)
+			}
+		}
+	}
+}
+
+//
+// Test retention on disk -- A Checkpoint or compaction drops revisions past -revision-age
+//
+func TestRevisionsPruned(t *testing.T) {
+	defer func(kind string, age time.Duration) { *storageKind, *maxRevisionAge = kind, age }(*storageKind, *maxRevisionAge)
+	defer removeDatabase()
+	t0 := now()
+	history := []Revision{{Rev: 1, Saved: t0.Add(-72 * time.Hour), Body: []byte("old")}, {Rev: 2, Saved: t0.Add(-time.Hour), Body: []byte("new")}}
+	for _, kind := range []string{"file", "disk"} {
+		removeDatabase()
+		*storageKind = kind
+		*maxRevisionAge = 0
+		loadDatabase()
+		testCheck(db.Put(Page{Name: "Ann", Body: []byte("Ann Data"), Rev: 3, Saved: t0, History: history}))
+
+		*maxRevisionAge = 24 * time.Hour
+		switch s := db.(type) {
+		case *fileStorage:
+			testCheck(s.checkpoint())
+		case *diskStorage:
+			testCheck(s.compact())
+		}
+		for _, from := range []string{"memory", "disk"} {
+			if p, _ := db.Get("Ann"); !reflect.DeepEqual(historyRevs(p), []int{2}) {
+				t.Errorf("%s, %s: History %v, Expected [2]", kind, from, historyRevs(p))
+			}
+			loadDatabase()
+		}
+	}
+}
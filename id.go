@@ -0,0 +1,47 @@
+// id - Stable Page Identifiers.
+// Every Page gets a ULID when it is created: 48 bits of millisecond time
+// followed by 80 random bits, written as 26 Crockford base32 characters.
+// IDs sort by creation time and never change, unlike Page.Index.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ" // Crockford base32 alphabet
+
+//
+// New ULID for the current time
+//
+func newID() string {
+	return makeID(time.Now(), nil)
+}
+
+//
+// ULID for t -- entropy supplies the 10 random bytes (crypto/rand when nil)
+//
+func makeID(t time.Time, entropy []byte) string {
+	var id [16]byte
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(t.UnixNano()/int64(time.Millisecond)))
+	copy(id[:6], ms[2:]) // 48-bit timestamp
+	if entropy == nil {
+		entropy = make([]byte, 10)
+		_, err := rand.Read(entropy)
+		check("Random ID Failed", err)
+	}
+	copy(id[6:], entropy)
+
+	// 128 bits ==> 26 characters of 5 bits (the first one carries only 3)
+	var out [26]byte
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,89 @@
+// id_test - Test Suite for the db_demo Stable Page Identifiers.
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Test makeID -- Known ULID timestamp, sort order and uniqueness
+//
+func TestMakeID(t *testing.T) {
+	id := makeID(time.Unix(0, 1469922850259*int64(time.Millisecond)), make([]byte, 10))
+	if id != "01ARZ3NDEK0000000000000000" {
+		t.Errorf("makeID = %s, Expected 01ARZ3NDEK0000000000000000", id)
+	}
+
+	var ids []string
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := makeID(time.Unix(int64(i), 0), nil)
+		if len(id) != 26 || seen[id] {
+			t.Fatal("Bad or duplicate ID: ", id)
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if !sort.StringsAreSorted(ids) {
+		t.Error("IDs do not sort by creation time")
+	}
+}
+
+//
+// Test stable IDs -- Kept across save, delete and restart; found by /id/
+//
+func TestStableIDs(t *testing.T) {
+	removeDatabase()
+	loadDatabase()
+	defer removeDatabase()
+
+	mike, _ := db.Get("Mike")
+	testCheck(db.Delete("Ann")) // Mike moves up in display order
+	testRequest(saveHandler, "POST", "/save/Mike", "body=Mike New Value")
+	loadDatabase()
+
+	p, ok := db.GetID(mike.ID)
+	if !ok || p.Name != "Mike" || string(p.Body) != "Mike New Value" || p.Index != mike.Index-1 {
+		t.Error("\nBefore = ", mike, "\nAfter  = ", p)
+	}
+	if _, ok := db.GetID(""); ok {
+		t.Error("Blank ID found")
+	}
+
+	w := testRequest(idHandler, "GET", "/id/"+mike.ID, "")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "<h1>View: Mike</h1>") {
+		t.Errorf("/id/%s = %q", mike.ID, w.Body.String())
+	}
+	w = testRequest(idHandler, "GET", "/id/01ARZ3NDEK0000000000000000", "")
+	if w.Body.String() != "<h1>View: ID not found!</h1>" {
+		t.Errorf("/id/ unknown = %q", w.Body.String())
+	}
+}
+
+//
+// Test IDs for old databases -- Assigned once at load and kept on disk
+//
+func TestMissingIDs(t *testing.T) {
+	removeDatabase()
+	defer removeDatabase()
+	err := ioutil.WriteFile(dataFile, []byte(cjmj_db), 0644) // Written before stable IDs
+	testCheck(err)
+
+	loadDatabase()
+	first := db.List()
+	loadDatabase()
+	if !reflect.DeepEqual(db.List(), first) {
+		t.Error("\nFirst load  = ", first, "\nSecond load = ", db.List())
+	}
+	for _, p := range first {
+		if len(p.ID) != 26 {
+			t.Error("No ID assigned: ", p)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// lock - One Process per Database Directory.
+// The Server and the offline subcommands hold an exclusive advisory lock
+// (flock) on Data.lock while they run, with their PID written in it. A
+// second process started in the same directory is refused and told which
+// PID holds the lock. The lock is on a file of its own because Data.db is
+// replaced by a rename on every checkpoint, which would drop a lock held
+// on it. The OS releases the lock when the process exits, however it exits.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const lockFile = "Data.lock" // Held by the process using the database
+
+var dbLock *os.File // The lock, for the life of the process -- Closing the file releases it
+
+var errLocked = errors.New("locked by another process")
+
+//
+// Lock the database -- An error naming the holder's PID if another process has it
+//
+func lockDatabase(file string) (*os.File, error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f); err != nil {
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		if err != errLocked {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		pid := strings.TrimSpace(string(data))
+		if len(pid) <= 0 {
+			pid = "unknown" // Holder has not written its PID yet
+		}
+		return nil, fmt.Errorf("%s is locked by process %s - another db_demo is using this directory", file, pid)
+	}
+	f.Truncate(0) // Best effort -- The PID is only for the message
+	f.WriteAt([]byte(fmt.Sprintln(os.Getpid())), 0)
+	return f, nil
+}
+
+//
+// Lock the database for this process -- Exit with the reason if it cannot be had
+//
+func mustLockDatabase() {
+	f, err := lockDatabase(lockFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Lock Database Failed:", err)
+		os.Exit(1)
+	}
+	dbLock = f
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+// lock_other - Database Lock without flock: Nothing is locked (see lock.go).
+package main
+
+import "os"
+
+const lockSupported = false // No flock -- A second process is not stopped
+
+//
+// Lock f -- Nothing to do without flock
+//
+func flock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,35 @@
+// lock_test - Test Suite for the db_demo Database Lock.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//
+// Test the Database Lock -- One holder at a time, the refusal names its PID
+//
+func TestLockDatabase(t *testing.T) {
+	if !lockSupported {
+		t.Skip("no flock on this system")
+	}
+	file := filepath.Join(t.TempDir(), lockFile)
+	f, err := lockDatabase(file)
+	testCheck(err)
+
+	_, err = lockDatabase(file) // A file of its own, like a second process
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprint("locked by process ", os.Getpid())) {
+		t.Errorf("second lock = %v", err)
+	}
+
+	testCheck(f.Close()) // Released, as when the process exits
+	f, err = lockDatabase(file)
+	if err != nil {
+		t.Errorf("lock after release = %v", err)
+	} else {
+		f.Close()
+	}
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+// lock_unix - flock for the Database Lock (see lock.go).
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const lockSupported = true // flock is available
+
+//
+// Take an exclusive flock on f without waiting -- errLocked if another process holds it
+//
+func flock(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
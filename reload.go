@@ -0,0 +1,106 @@
+// reload - Pick up a Data.db Changed on Disk.
+// Operators restore or hand-edit Data.db while the Server runs. The File
+// Storage looks at Data.db every -reload-interval; when its size,
+// modification time or identity changed other than through a Checkpoint,
+// the new file is read and validated as at startup. A good file replaces
+// the in-memory database at once (under one lock, as Restore does), and
+// Data.log, written against the old file, is dropped. A damaged file, or
+// one sealed with another key, is refused: it is moved aside to
+// Data.db.rejected and the Server writes what it is serving back to
+// Data.db, so a restart finds the same database. Replace Data.db by
+// renaming a complete file over it, not by writing into it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"time"
+)
+
+var reloadInterval = flag.Duration("reload-interval", 2*time.Second, "File storage: how often to check Data.db for changes made by others (0: never)")
+
+//
+// Same file state -- Identity, size and modification time all unchanged
+//
+func sameStamp(a, b os.FileInfo) bool {
+	return a != nil && b != nil && os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+//
+// Remember the state of Data.db as this Storage left it (logMu held)
+//
+func (s *fileStorage) stampFile() {
+	if info, err := os.Stat(s.file); err == nil {
+		s.stamp = info
+	}
+}
+
+//
+// Reload Data.db if something else changed it -- Returns whether it was reloaded
+//
+// The whole check runs under logMu, so no change or Checkpoint comes in
+// between; readers keep going until the swap.
+//
+func (s *fileStorage) reloadIfChanged() (bool, error) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	info, err := os.Stat(s.file)
+	if os.IsNotExist(err) {
+		return false, nil // The next Checkpoint writes it again
+	}
+	if err != nil {
+		return false, err
+	}
+	if sameStamp(info, s.stamp) {
+		return false, nil
+	}
+	pages, data, version, err := readSnapshot(s.file)
+	if err != nil {
+		rejected := s.file + ".rejected"
+		if rerr := os.Rename(s.file, rejected); rerr != nil {
+			return false, rerr
+		}
+		if werr := s.writeSnapshot(s.memStorage.List()); werr != nil { // Data.log applied to the file just moved
+			return false, werr
+		}
+		return false, fmt.Errorf("%s changed on disk and is refused (kept as %s) - still serving the database as it was: %v", s.file, rejected, err)
+	}
+	before := len(s.memStorage.List())
+	s.reset(pages)
+	s.snapshotSum = crc32.ChecksumIEEE(data)
+	s.logRecords = 0 // The Log applied to the old file
+	s.stamp = info
+	fmt.Printf("Reloaded %s: %d pages, was %d (%+d)\n", s.file, len(pages), before, len(pages)-before)
+	if version < formatVersion {
+		if err := s.keepBackup(data, version); err != nil {
+			return true, err
+		}
+	}
+	if version < formatVersion || missingIDs(pages) {
+		return true, s.writeSnapshot(s.memStorage.List()) // In the current format, with the IDs just given
+	}
+	if err := os.Remove(s.log); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+//
+// Reloader -- Check Data.db every interval
+//
+func (s *fileStorage) reloader(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-tick.C:
+		}
+		if _, err := s.reloadIfChanged(); err != nil {
+			fmt.Println("Reload Failed:", err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// reload_test - Test Suite for the db_demo Reload of a Changed Data.db.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Replace Data.db as an operator would -- Written beside it and renamed over it
+//
+func testReplaceData(pages []Page) {
+	data, err := encodeSnapshot(pages, "json")
+	testCheck(err)
+	testCheck(ioutil.WriteFile(dataFile+".new", data, 0644))
+	testCheck(os.Rename(dataFile+".new", dataFile))
+}
+
+//
+// Test reloading Data.db -- A good replacement is taken, a bad one refused
+//
+func TestReload(t *testing.T) {
+	defer func(kind string, interval time.Duration) { *storageKind, *reloadInterval = kind, interval }(*storageKind, *reloadInterval)
+	removeDatabase()
+	defer removeDatabase()
+	*storageKind, *reloadInterval = "file", 0
+	loadDatabase()
+	s := db.(*fileStorage)
+	testCheck(s.Put(Page{Name: "Henry", Body: []byte("Henry Data")})) // In Data.log only
+	testCheck(s.checkpoint())
+	if ok, err := s.reloadIfChanged(); ok || err != nil {
+		t.Errorf("own Checkpoint reloaded: %v, %v", ok, err)
+	}
+
+	testCheck(s.Put(Page{Name: "Zed", Body: []byte("Lost with the old file")}))
+	pages := testData()[:2]
+	pages = append(pages, Page{Name: "Restored", Body: []byte("Restored Data")})
+	testReplaceData(pages)
+	if ok, err := s.reloadIfChanged(); !ok || err != nil {
+		t.Fatalf("reload = %v, %v", ok, err)
+	}
+	want := []string{"Charles=Charles Data", "Ann=Ann Data", "Restored=Restored Data"}
+	if got := namesAndBodies(s.List()); !reflect.DeepEqual(got, want) {
+		t.Errorf("reloaded\n\tExpected:\t%q\n\tGot:\t%q", want, got)
+	}
+	if _, err := os.Stat("Data.log"); !os.IsNotExist(err) {
+		t.Errorf("old Data.log kept: %v", err)
+	}
+
+	testCheck(ioutil.WriteFile(dataFile, []byte(`{"Version":7,"Pages":[{"Name":"tru`), 0644))
+	if ok, err := s.reloadIfChanged(); ok || err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("damaged file: %v, %v", ok, err)
+	}
+	if ok, err := s.reloadIfChanged(); ok || err != nil {
+		t.Errorf("after refusal: %v, %v", ok, err)
+	}
+	if data, err := ioutil.ReadFile(dataFile + ".rejected"); err != nil || !strings.HasSuffix(string(data), "tru") {
+		t.Errorf("refused file not kept: %q, %v", data, err)
+	}
+	if got := namesAndBodies(s.List()); !reflect.DeepEqual(got, want) {
+		t.Errorf("damaged file changed the database: %q", got)
+	}
+
+	testCheck(s.Put(Page{Name: "Ann", Body: []byte("Saved after")})) // Still served and saved
+	loadDatabase()
+	want[1] = "Ann=Saved after"
+	if got := namesAndBodies(db.List()); !reflect.DeepEqual(got, want) {
+		t.Errorf("restarted\n\tExpected:\t%q\n\tGot:\t%q", want, got)
+	}
+}
+
+//
+// Test the Reloader -- Running every -reload-interval
+//
+func TestReloader(t *testing.T) {
+	defer func(kind string, interval time.Duration) { *storageKind, *reloadInterval = kind, interval }(*storageKind, *reloadInterval)
+	removeDatabase()
+	defer removeDatabase()
+	*storageKind, *reloadInterval = "file", 10*time.Millisecond
+	loadDatabase()
+	testReplaceData(append(testData(), Page{Name: "Henry", Body: []byte("Henry Data")}))
+	for i := 0; i < 100; i++ {
+		if _, ok := db.Get("Henry"); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Data.db not reloaded")
+}
@@ -0,0 +1,491 @@
+// sqlite - SQLite Storage: Data.sqlite.
+// The Pages live in one "pages" table keyed by Name. Every lookup is a
+// query and every change a transaction, so nothing but the connection pool
+// is held in memory. This file only uses database/sql; the pure-Go driver
+// (no cgo) is linked in by building with -tags sqlite (see sqlite_driver.go),
+// so the default build needs no code from outside the standard library.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const sqliteFile = "Data.sqlite" // SQLite Storage Database
+
+var sqlDriver string // database/sql driver -- Empty: built without SQLite
+
+var sqlDSN func(file, synchronous string) string // Data source for file, with PRAGMA synchronous set
+
+var sqlSchema = []string{ // Run in one transaction when Data.sqlite is new
+	`CREATE TABLE pages (
+		name    TEXT PRIMARY KEY,     -- The key
+		id      TEXT NOT NULL UNIQUE, -- Stable ID
+		idx     INTEGER NOT NULL,     -- Display order, renumbered by deletes
+		version INTEGER NOT NULL,
+		meta    TEXT NOT NULL,        -- Revisions and expiry as JSON (sqlMeta)
+		body    BLOB,
+		sum     INTEGER NOT NULL      -- pageSum of the whole Page
+	)`,
+	`CREATE INDEX pages_idx ON pages (idx)`,
+}
+
+const sqlColumns = "id, idx, name, version, meta, body, sum" // Every column, as scanPage reads them
+
+const sqlMetaColumns = "id, idx, name, version, meta" // ... without the Body
+
+type sqlMeta struct { // The meta column -- Page fields that need no column of their own
+	Rev     int        `json:",omitempty"`
+	Saved   time.Time  `json:",omitzero"`
+	History []Revision `json:",omitempty"`
+	Expires time.Time  `json:",omitzero"`
+	Deleted time.Time  `json:",omitzero"`
+}
+
+type sqlQuerier interface { // *sql.DB or *sql.Tx
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type rowScanner interface { // *sql.Row or *sql.Rows
+	Scan(dest ...interface{}) error
+}
+
+type sqlStorage struct { // SQLite Storage
+	db      *sql.DB    // Data.sqlite
+	file    string     // Its name
+	writeMu sync.Mutex // Serializes changes -- SQLite takes one writer at a time anyway
+}
+
+//
+// Open SQLite Storage -- A new Data.sqlite starts from Data.db if there is one
+//
+// -fsync maps to PRAGMA synchronous: always is FULL, interval NORMAL (the
+// last transactions can be lost in a power cut, never the file), none OFF.
+//
+func openSQLStorage(file string) (*sqlStorage, error) {
+	if len(sqlDriver) <= 0 {
+		return nil, fmt.Errorf("built without SQLite - rebuild with -tags sqlite")
+	}
+	if dataKey != nil {
+		return nil, fmt.Errorf("encryption at rest (-key-file, $%s) is not supported with SQLite storage", keyEnv)
+	}
+	synchronous, ok := map[string]string{"always": "FULL", "interval": "NORMAL", "none": "OFF"}[*fsyncPolicy]
+	if !ok {
+		return nil, fmt.Errorf("unknown fsync policy %q (always, interval or none)", *fsyncPolicy)
+	}
+	db, err := sql.Open(sqlDriver, sqlDSN(file, synchronous))
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStorage{db: db, file: file}
+	var tables int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'pages'").Scan(&tables)
+	if err == nil && tables == 0 {
+		err = s.seed()
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return s, nil
+}
+
+//
+// Seed a new Data.sqlite -- The table and its Pages in one transaction
+//
+// From Data.db (with Data.log) if there is one, otherwise the test data.
+// A crash part way leaves no table, so the next start seeds again.
+//
+func (s *sqlStorage) seed() error {
+	pages, err := importDataFile(s.file)
+	if err != nil {
+		return err
+	}
+	return s.change(func(tx *sql.Tx) error {
+		for _, stmt := range sqlSchema {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return sqlReplace(tx, uniqueNames(pages))
+	})
+}
+
+//
+// Run f in a transaction -- Committed if f succeeds, rolled back if not
+//
+func (s *sqlStorage) change(f func(tx *sql.Tx) error) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//
+// Scan a row into a Page -- With full, the Body too and the checksum verified
+//
+func scanPage(row rowScanner, full bool) (Page, error) {
+	var p Page
+	var meta string
+	var sum int64
+	dest := []interface{}{&p.ID, &p.Index, &p.Name, &p.Version, &meta}
+	if full {
+		dest = append(dest, &p.Body, &sum)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return p, err
+	}
+	var m sqlMeta
+	if err := json.Unmarshal([]byte(meta), &m); err != nil {
+		return p, fmt.Errorf("%q: %v", p.Name, err)
+	}
+	p.Rev, p.Saved, p.History, p.Expires, p.Deleted = m.Rev, m.Saved, m.History, m.Expires, m.Deleted
+	if full && uint32(sum) != pageSum(p) {
+		return p, fmt.Errorf("%q: checksum mismatch", p.Name)
+	}
+	return p, nil
+}
+
+//
+// Column values of a Page, in sqlColumns order
+//
+func sqlValues(p Page) ([]interface{}, error) {
+	meta, err := json.Marshal(sqlMeta{Rev: p.Rev, Saved: p.Saved, History: p.History, Expires: p.Expires, Deleted: p.Deleted})
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{p.ID, p.Index, p.Name, p.Version, string(meta), p.Body, int64(pageSum(p))}, nil
+}
+
+//
+// Find the Page whose column (name or id) is value
+//
+func sqlFind(q sqlQuerier, column, value string) (Page, bool, error) {
+	p, err := scanPage(q.QueryRow("SELECT "+sqlColumns+" FROM pages WHERE "+column+" = ?", value), true)
+	if err == sql.ErrNoRows {
+		return Page{}, false, nil
+	}
+	if err != nil {
+		return Page{}, false, err
+	}
+	return p, true, nil
+}
+
+//
+// Insert a new Page
+//
+func sqlInsert(tx *sql.Tx, p Page) error {
+	values, err := sqlValues(p)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO pages ("+sqlColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)", values...)
+	return err
+}
+
+//
+// Update the Page with p.ID -- Name included, for a rename
+//
+func sqlUpdate(tx *sql.Tx, p Page) error {
+	values, err := sqlValues(p)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE pages SET id = ?, idx = ?, name = ?, version = ?, meta = ?, body = ?, sum = ? WHERE id = ?", append(values, p.ID)...)
+	return err
+}
+
+//
+// Put in a transaction -- As memStorage.put: ID kept, Version checked and bumped
+//
+func sqlPut(tx *sql.Tx, p Page) error {
+	if len(p.Name) <= 0 {
+		return errBlankName
+	}
+	old, ok, err := sqlFind(tx, "name", p.Name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		p.ID = old.ID // IDs never change
+	} else if len(p.ID) <= 0 {
+		p.ID = newID()
+	} else if _, taken, err := sqlFind(tx, "id", p.ID); err != nil {
+		return err
+	} else if taken {
+		return errDuplicateID
+	}
+	if (p.Version == versionNew && ok) || (p.Version > 0 && (!ok || old.Version != p.Version)) {
+		return errConflict
+	}
+	if ok {
+		p.Index, p.Version = old.Index, old.Version+1
+		return sqlUpdate(tx, p)
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM pages").Scan(&p.Index); err != nil {
+		return err
+	}
+	p.Version = 1
+	return sqlInsert(tx, p)
+}
+
+//
+// Delete in a transaction -- The Pages after it move up in display order
+//
+// Only a Page live at t is found, as for memStorage.checkBatch; zero t
+// finds any (a purge).
+//
+func sqlDelete(tx *sql.Tx, name string, version int, t time.Time) error {
+	p, ok, err := sqlFind(tx, "name", name)
+	if err != nil {
+		return err
+	}
+	if !ok || (!t.IsZero() && !live(p, t)) {
+		return errNotFound
+	}
+	if version != 0 && p.Version != version {
+		return errConflict
+	}
+	if _, err := tx.Exec("DELETE FROM pages WHERE id = ?", p.ID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE pages SET idx = idx - 1 WHERE idx > ?", p.Index)
+	return err
+}
+
+//
+// Rename in a transaction -- Same place, ID and History; the next Version
+//
+// Only a Page live at t is renamed, and an expired or trashed Page under
+// newName is purged first, as for memStorage.checkBatch.
+//
+func sqlRename(tx *sql.Tx, name, newName string, version int, t time.Time) error {
+	p, ok, err := sqlFind(tx, "name", name)
+	if err != nil {
+		return err
+	}
+	ok = ok && live(p, t)
+	q, taken, err := sqlFind(tx, "name", newName)
+	if err != nil {
+		return err
+	}
+	if taken && !live(q, t) && ok {
+		if err := sqlDelete(tx, newName, 0, time.Time{}); err != nil {
+			return err
+		}
+		if p, _, err = sqlFind(tx, "id", p.ID); err != nil { // Moved up if the purged Page was before it
+			return err
+		}
+		taken = false
+	}
+	switch {
+	case !ok:
+		return errNotFound
+	case version != 0 && p.Version != version:
+		return errConflict
+	case len(newName) <= 0:
+		return errBlankName
+	case taken:
+		return errNameTaken
+	}
+	p.Name = newName
+	p.Version++
+	return sqlUpdate(tx, p)
+}
+
+//
+// Trash (deleted set) or restore (zero deleted) in a transaction -- The next Version
+//
+// A trash only finds a Page live at t, a restore one in the trash at t, as
+// for memStorage.checkBatch. The body column is not written.
+//
+func sqlSetDeleted(tx *sql.Tx, name string, version int, deleted, t time.Time) error {
+	p, ok, err := sqlFind(tx, "name", name)
+	if err != nil {
+		return err
+	}
+	if deleted.IsZero() {
+		ok = ok && inTrash(p, t)
+	} else {
+		ok = ok && live(p, t)
+	}
+	switch {
+	case !ok:
+		return errNotFound
+	case version != 0 && p.Version != version:
+		return errConflict
+	}
+	p.Deleted = deleted
+	p.Version++
+	values, err := sqlValues(p) // In sqlColumns order
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE pages SET version = ?, meta = ?, sum = ? WHERE id = ?", values[3], values[4], values[6], p.ID)
+	return err
+}
+
+//
+// Replace every Page in a transaction -- Index renumbered, IDs and Versions kept
+//
+func sqlReplace(tx *sql.Tx, pages []Page) error {
+	if _, err := tx.Exec("DELETE FROM pages"); err != nil {
+		return err
+	}
+	for i, p := range pages {
+		p.Index = i
+		if len(p.ID) <= 0 {
+			p.ID = newID()
+		}
+		if p.Version <= 0 {
+			p.Version = 1 // Written before Versions
+		}
+		if err := sqlInsert(tx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Get -- SELECT by Name
+//
+func (s *sqlStorage) Get(name string) (Page, bool) {
+	p, ok, err := sqlFind(s.db, "name", name)
+	check("SQL Read Failed", err)
+	return p, ok
+}
+
+//
+// GetID -- SELECT by stable ID
+//
+func (s *sqlStorage) GetID(id string) (Page, bool) {
+	p, ok, err := sqlFind(s.db, "id", id)
+	check("SQL Read Failed", err)
+	return p, ok
+}
+
+//
+// Put -- Read, check and write the Page in one transaction
+//
+func (s *sqlStorage) Put(p Page) error {
+	return s.change(func(tx *sql.Tx) error { return sqlPut(tx, p) })
+}
+
+//
+// Delete -- Remove the Page and renumber the rest in one transaction
+//
+func (s *sqlStorage) Delete(name string) error {
+	return s.change(func(tx *sql.Tx) error { return sqlDelete(tx, name, 0, now()) })
+}
+
+//
+// Apply a Batch -- One transaction; the first failing Operation rolls it all back
+//
+func (s *sqlStorage) Apply(ops []Op) error {
+	t := now()
+	return s.change(func(tx *sql.Tx) error {
+		for i, op := range ops {
+			var err error
+			switch op.Op {
+			case "put":
+				err = sqlPut(tx, op.Page)
+			case "delete":
+				err = sqlDelete(tx, op.Name, op.Version, t)
+			case "purge":
+				err = sqlDelete(tx, op.Name, op.Version, time.Time{})
+			case "rename":
+				err = sqlRename(tx, op.Name, op.NewName, op.Version, t)
+			case "trash":
+				err = sqlSetDeleted(tx, op.Name, op.Version, op.Deleted, t)
+			case "restore":
+				err = sqlSetDeleted(tx, op.Name, op.Version, time.Time{}, t)
+			default:
+				err = fmt.Errorf("unknown operation %q", op.Op)
+			}
+			if err != nil {
+				return &batchError{Index: i, Op: op, Err: err}
+			}
+		}
+		return nil
+	})
+}
+
+//
+// List -- Every Page in Index order (nil for an empty Database)
+//
+func (s *sqlStorage) List() []Page {
+	return s.list(sqlColumns, true, "")
+}
+
+//
+// List Metadata -- Every Page without its Body
+//
+func (s *sqlStorage) ListMetadata() []Page {
+	return s.list(sqlMetaColumns, false, "")
+}
+
+//
+// Search Metadata -- Pages with a Name containing substr, without the Body, in one query
+//
+func (s *sqlStorage) SearchMetadata(substr string) []Page {
+	return s.list(sqlMetaColumns, false, " WHERE instr(name, ?) > 0", substr)
+}
+
+//
+// SELECT columns of every Page (matching where, with args) in Index order
+//
+func (s *sqlStorage) list(columns string, full bool, where string, args ...interface{}) []Page {
+	rows, err := s.db.Query("SELECT "+columns+" FROM pages"+where+" ORDER BY idx", args...)
+	check("SQL Read Failed", err)
+	defer rows.Close()
+	var pages []Page
+	for rows.Next() {
+		p, err := scanPage(rows, full)
+		check("SQL Read Failed", err)
+		pages = append(pages, p)
+	}
+	check("SQL Read Failed", rows.Err())
+	return pages
+}
+
+//
+// Search -- Names containing substr (instr is case-sensitive, like strings.Contains)
+//
+func (s *sqlStorage) Search(substr string) []string {
+	rows, err := s.db.Query("SELECT name FROM pages WHERE instr(name, ?) > 0 ORDER BY idx", substr)
+	check("SQL Read Failed", err)
+	defer rows.Close()
+	var found []string
+	for rows.Next() {
+		var name string
+		check("SQL Read Failed", rows.Scan(&name))
+		found = append(found, name)
+	}
+	check("SQL Read Failed", rows.Err())
+	return found
+}
+
+//
+// Restore -- Replace every Page in one transaction
+//
+func (s *sqlStorage) Restore(pages []Page) error {
+	return s.change(func(tx *sql.Tx) error { return sqlReplace(tx, pages) })
+}
+
+//
+// Close -- Close the connection pool
+//
+func (s *sqlStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,24 @@
+//go:build sqlite
+
+// sqlite_driver - The pure-Go SQLite driver for the SQLite Storage.
+// Only built with -tags sqlite, so the default build stays within the
+// standard library. modernc.org/sqlite is SQLite translated to Go: no cgo.
+// Tested with v1.60.1 -- See README.md for the module and build commands.
+package main
+
+import (
+	"net/url"
+
+	_ "modernc.org/sqlite" // Registers "sqlite" with database/sql
+)
+
+func init() {
+	sqlDriver = "sqlite"
+	sqlDSN = func(file, synchronous string) string {
+		q := url.Values{}
+		q.Add("_pragma", "busy_timeout(5000)") // Wait for a writer instead of failing
+		q.Add("_pragma", "journal_mode(WAL)")  // Readers do not block the writer
+		q.Add("_pragma", "synchronous("+synchronous+")")
+		return "file:" + file + "?" + q.Encode()
+	}
+}
@@ -0,0 +1,100 @@
+// sqlite_test - Test Suite for the db_demo SQLite Storage.
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// SQLite Storage for a test -- Skipped unless built with -tags sqlite
+//
+func testSQLite(t *testing.T) {
+	if len(sqlDriver) > 0 {
+		return
+	}
+	if _, err := openStorage("sqlite"); err == nil || !strings.Contains(err.Error(), "-tags sqlite") {
+		t.Errorf("openStorage without a driver = %v", err)
+	}
+	t.Skip("built without SQLite - run with -tags sqlite")
+}
+
+//
+// Test the SQLite Storage -- Same results as memory for the handlers and batches
+//
+func TestSQLStorage(t *testing.T) {
+	testSQLite(t)
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+	results := map[string][]string{}
+	views := map[string]string{}
+	for _, kind := range []string{"memory", "sqlite"} {
+		removeDatabase()
+		*storageKind = kind
+		loadDatabase()
+		testRequest(saveHandler, "POST", "/save/Ann", "body=New Ann Data")
+		testRequest(deleteHandler, "GET", "/delete/Mike", "")
+		testCheck(db.Apply([]Op{
+			{Op: "put", Page: Page{Name: "Henry", Body: []byte("Henry Data")}},
+			{Op: "rename", Name: "Jack", NewName: "John"},
+		}))
+		if err := db.Apply([]Op{{Op: "rename", Name: "Mike", NewName: "Zed"}}); opError(err) != errNotFound {
+			t.Errorf("%s: rename of a trashed Page = %v", kind, err)
+		}
+		testCheck(db.Apply([]Op{{Op: "rename", Name: "Charles", NewName: "Mike"}})) // Trashed Mike purged first
+		err := db.Apply([]Op{{Op: "delete", Name: "Ann"}, {Op: "delete", Name: "Ann"}})
+		if be, ok := err.(*batchError); !ok || be.Index != 1 || be.Err != errNotFound {
+			t.Errorf("%s: bad Batch = %v", kind, err)
+		}
+		if err := db.Put(Page{Name: "Ann", Version: 1}); err != errConflict {
+			t.Errorf("%s: stale Put = %v", kind, err)
+		}
+		if err := db.Put(Page{}); err != errBlankName {
+			t.Errorf("%s: blank Put = %v", kind, err)
+		}
+		testCheck(trashPage(db, "Jacky", now()))
+		testCheck(restorePage(db, "Jacky"))
+		if err := db.Apply([]Op{{Op: "trash", Name: "Jacky", Version: 1, Deleted: now()}}); opError(err) != errConflict {
+			t.Errorf("%s: stale trash = %v", kind, err)
+		}
+		views[kind] = testRequest(viewHandler, "GET", "/view/", "").Body.String()
+		results[kind] = namesAndBodies(db.List())
+		if got := db.Search("Jac"); !reflect.DeepEqual(got, []string{"Jacky"}) {
+			t.Errorf("%s: Search = %q", kind, got)
+		}
+		if p, ok := findName(db, "Jac"); !ok || string(p.Body) != "Jacky Data" { // Matched by metadata, then read
+			t.Errorf("%s: findName = %q, %v", kind, p.Body, ok)
+		}
+	}
+	if !reflect.DeepEqual(results["sqlite"], results["memory"]) || views["sqlite"] != views["memory"] {
+		t.Errorf("\nsqlite = %q\nmemory = %q", results["sqlite"], results["memory"])
+	}
+
+	*storageKind = "sqlite" // Everything was in the file
+	loadDatabase()
+	if got := namesAndBodies(db.List()); !reflect.DeepEqual(got, results["memory"]) {
+		t.Errorf("reopened = %q", got)
+	}
+	removeDatabase()
+}
+
+//
+// Test the migration -- A new Data.sqlite starts from Data.db
+//
+func TestSQLImport(t *testing.T) {
+	testSQLite(t)
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+	removeDatabase()
+	defer removeDatabase()
+	*storageKind = "file"
+	loadDatabase()
+	testCheck(db.Put(Page{Name: "Henry", Body: []byte("Henry Data")}))
+	testCheck(db.Delete("Ann"))
+	want := db.List()
+
+	*storageKind = "sqlite"
+	loadDatabase()
+	if got := db.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("\nImported = %v\nExpected = %v", got, want)
+	}
+}
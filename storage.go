@@ -0,0 +1,414 @@
+// storage - Pluggable Storage for the db_demo database.
+// The handlers only see the Storage interface; the backend is picked at
+// startup with -storage (file, disk, dir, sqlite or memory).
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Storage interface { // Database Storage Backend
+	Get(name string) (Page, bool)  // Page with exactly this Name
+	GetID(id string) (Page, bool)  // Page with this stable ID
+	Put(p Page) error              // Replace the Page with p.Name (ID kept), or append a new one -- see checkVersion
+	Delete(name string) error      // Remove the Page and renumber the rest
+	Apply(ops []Op) error          // Every Operation of a Batch, or none -- see batch.go
+	List() []Page                  // All Pages in Index order
+	Search(substr string) []string // Names containing substr, in Index order
+	Restore(pages []Page) error    // Replace every Page at once -- see admin.go
+	Close() error                  // Release the Backend
+}
+
+var db Storage // Database Storage selected at startup
+
+var errNotFound = errors.New("name not found")
+var errBlankName = errors.New("blank name")
+var errDuplicateID = errors.New("ID already belongs to another page")
+var errConflict = errors.New("page changed since it was read")
+var errNameTaken = errors.New("name already taken")
+
+const versionNew = -1 // Page.Version of a Put that only creates -- No Page may have the Name yet
+
+//
+// Open the Storage Backend named by kind
+//
+func openStorage(kind string) (Storage, error) {
+	if err := checkCompression(*compressAlgo); err != nil {
+		return nil, err
+	}
+	key, err := loadKey(*keyFile, os.Getenv(keyEnv))
+	if err != nil {
+		return nil, err
+	}
+	dataKey = key
+	switch kind {
+	case "file":
+		s, err := openFileStorage(dataFile, *dataEncoding)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "disk":
+		s, err := openDiskStorage(pagesFile, *cacheBytes)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "dir":
+		s, err := openDirStorage(pagesDir)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "sqlite":
+		s, err := openSQLStorage(sqliteFile)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "memory":
+		return newMemStorage(testData()), nil
+	}
+	return nil, fmt.Errorf("unknown storage %q", kind)
+}
+
+//
+// Initial Database with Test Data - Remove appends below for empty database
+//
+func testData() []Page {
+	var pages []Page
+	pages = append(pages, Page{Index: 0, Name: "Charles", Body: []byte("Charles Data")})
+	pages = append(pages, Page{Index: 1, Name: "Ann", Body: []byte("Ann Data")})
+	pages = append(pages, Page{Index: 2, Name: "Jack", Body: []byte("Jack Data")})
+	pages = append(pages, Page{Index: 3, Name: "Mike", Body: []byte("Mike Data")})
+	pages = append(pages, Page{Index: 4, Name: "Jacky", Body: []byte("Jacky Data")})
+	return pages
+}
+
+//
+// Pages for a new Storage file -- Imported from Data.db (with Data.log) if there is one
+//
+// Without Data.db it is the test data, as for the File Storage. into only
+// names the new file for the message.
+//
+func importDataFile(into string) ([]Page, error) {
+	if _, err := os.Stat(dataFile); err != nil {
+		return testData(), nil
+	}
+	fmt.Println("Importing", dataFile, "into", into)
+	fs, err := openFileStorage(dataFile, *dataEncoding)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+	return fs.List(), nil
+}
+
+type memStorage struct { // In-memory Storage -- Nothing is written to disk
+	mu     sync.RWMutex   // Writers one at a time, Readers in parallel
+	pages  []Page         // Pages in Index order
+	byName map[string]int // Hash Index: Name ==> position in pages
+	byID   map[string]int // Hash Index: ID ==> position in pages
+	grams  trigramIndex   // Substring Search Index over Names
+}
+
+//
+// Create an in-memory Storage holding pages
+//
+func newMemStorage(pages []Page) *memStorage {
+	s := &memStorage{}
+	s.reset(pages)
+	return s
+}
+
+//
+// Replace every Page and rebuild the Indexes
+//
+// Index is only the display order, so it is renumbered here. Pages from
+// before stable IDs get one now.
+//
+func (s *memStorage) reset(pages []Page) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replace(pages)
+}
+
+//
+// Replace every Page and rebuild the indexes (s.mu held)
+//
+func (s *memStorage) replace(pages []Page) {
+	s.pages = pages
+	s.byName = make(map[string]int, len(pages))
+	s.byID = make(map[string]int, len(pages))
+	s.grams = trigramIndex{}
+	for i := range pages {
+		pages[i].Index = i
+		if len(pages[i].ID) <= 0 {
+			pages[i].ID = newID()
+		}
+		if pages[i].Version <= 0 {
+			pages[i].Version = 1 // Written before Versions
+		}
+	}
+	for i := len(pages) - 1; i >= 0; i-- { // First Page wins if a Name is duplicated
+		s.byName[pages[i].Name] = i
+		s.byID[pages[i].ID] = i
+		s.grams.add(pages[i].Name)
+	}
+}
+
+//
+// Get -- Locates by "equality" match through the Hash Index
+//
+func (s *memStorage) Get(name string) (Page, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.byName[name]
+	if !ok {
+		return Page{}, false
+	}
+	return s.pages[i], true
+}
+
+//
+// GetID -- Locates by stable ID through the Hash Index
+//
+func (s *memStorage) GetID(id string) (Page, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.byID[id]
+	if !ok {
+		return Page{}, false
+	}
+	return s.pages[i], true
+}
+
+//
+// Stable ID for p -- The stored Page keeps its ID, a new Page gets one (s.mu held)
+//
+func (s *memStorage) withID(p Page) (Page, error) {
+	if i, ok := s.byName[p.Name]; ok {
+		p.ID = s.pages[i].ID // IDs never change
+		return p, nil
+	}
+	if len(p.ID) <= 0 {
+		p.ID = newID()
+	} else if _, ok := s.byID[p.ID]; ok {
+		return p, errDuplicateID
+	}
+	return p, nil
+}
+
+//
+// Check the Version a Put expects -- Zero puts unconditionally (s.mu held)
+//
+// versionNew only creates: a Page under the Name is a conflict. Otherwise
+// the stored Page must still have that Version; a Page deleted since it
+// was read is a conflict too.
+//
+func (s *memStorage) checkVersion(p Page) error {
+	i, ok := s.byName[p.Name]
+	switch {
+	case p.Version == 0:
+		return nil
+	case p.Version == versionNew && !ok:
+		return nil
+	case ok && s.pages[i].Version == p.Version:
+		return nil
+	}
+	return errConflict
+}
+
+//
+// Put -- Replace in place (Index and ID unchanged) or append with the next Index
+//
+// The stored Page gets the next Version; a new Page starts at 1.
+//
+func (s *memStorage) Put(p Page) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(p)
+}
+
+//
+// Put with s.mu held
+//
+func (s *memStorage) put(p Page) error {
+	if len(p.Name) <= 0 {
+		return errBlankName
+	}
+	p, err := s.withID(p)
+	if err != nil {
+		return err
+	}
+	if err := s.checkVersion(p); err != nil {
+		return err
+	}
+	if i, ok := s.byName[p.Name]; ok {
+		p.Index = i
+		p.Version = s.pages[i].Version + 1
+		s.pages[i] = p
+		return nil
+	}
+	p.Index = len(s.pages)
+	p.Version = 1
+	s.pages = append(s.pages, p)
+	s.byName[p.Name] = p.Index
+	s.byID[p.ID] = p.Index
+	s.grams.add(p.Name)
+	return nil
+}
+
+//
+// Delete -- Remove the Page; the ones after it move up in display order
+//
+// An expired or trashed Page is not found, as for a delete in a Batch.
+//
+func (s *memStorage) Delete(name string) error {
+	return opError(s.Apply([]Op{{Op: "delete", Name: name}}))
+}
+
+//
+// Delete with s.mu held
+//
+func (s *memStorage) remove(name string) error {
+	i, ok := s.byName[name]
+	if !ok {
+		return errNotFound
+	}
+	zMem := make([]Page, 0, len(s.pages)-1) // New Database
+	zMem = append(zMem, s.pages[:i]...)
+	for _, v := range s.pages[i+1:] {
+		v.Index = len(zMem) // Display order only -- IDs stay the same
+		s.byName[v.Name] = v.Index
+		s.byID[v.ID] = v.Index
+		zMem = append(zMem, v)
+	}
+	delete(s.byName, name)
+	delete(s.byID, s.pages[i].ID)
+	s.grams.remove(name)
+	if len(zMem) == 0 {
+		zMem = nil // Empty Database
+	}
+	s.pages = zMem
+	return nil
+}
+
+//
+// Rename with s.mu held -- Same place, ID and History; the next Version
+//
+func (s *memStorage) rename(name, newName string) error {
+	i, ok := s.byName[name]
+	if !ok {
+		return errNotFound
+	}
+	if len(newName) <= 0 {
+		return errBlankName
+	}
+	if _, ok := s.byName[newName]; ok {
+		return errNameTaken
+	}
+	p := s.pages[i]
+	p.Name = newName
+	p.Version++
+	s.pages[i] = p
+	delete(s.byName, name)
+	s.byName[newName] = i
+	s.grams.remove(name)
+	s.grams.add(newName)
+	return nil
+}
+
+//
+// Trash or restore with s.mu held -- Only Deleted changes; the next Version
+//
+func (s *memStorage) setDeleted(name string, t time.Time) error {
+	i, ok := s.byName[name]
+	if !ok {
+		return errNotFound
+	}
+	s.pages[i].Deleted = t
+	s.pages[i].Version++
+	return nil
+}
+
+//
+// Apply a Batch -- Every Operation or none (see batch.go)
+//
+func (s *memStorage) Apply(ops []Op) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ops, err := s.checkBatch(ops, now())
+	if err != nil {
+		return err
+	}
+	return s.applyBatch(ops)
+}
+
+//
+// Apply Operations as logged -- Checked when they were written, so every Page is seen
+//
+// A replay must not depend on the time it runs at: a Page live when the
+// Operation was logged may have expired since.
+//
+func (s *memStorage) applyLogged(ops []Op) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.checkBatch(ops, time.Time{}); err != nil {
+		return err
+	}
+	return s.applyBatch(ops)
+}
+
+//
+// List -- Copy of all Pages (nil for an empty Database)
+//
+func (s *memStorage) List() []Page {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Page(nil), s.pages...)
+}
+
+//
+// Restore -- Replace every Page under one lock
+//
+func (s *memStorage) Restore(pages []Page) error {
+	s.reset(append([]Page(nil), pages...))
+	return nil
+}
+
+//
+// Search -- Names containing substr, checked only against Trigram candidates
+//
+func (s *memStorage) Search(substr string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names, ok := s.grams.candidates(substr)
+	if !ok { // Too short for the Index -- Scan every Name
+		names = nil
+		for _, p := range s.pages {
+			names = append(names, p.Name)
+		}
+	}
+	var found []string
+	for _, name := range names {
+		if strings.Contains(name, substr) {
+			found = append(found, name)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return s.byName[found[i]] < s.byName[found[j]] })
+	return found
+}
+
+//
+// Close -- Nothing to release
+//
+func (s *memStorage) Close() error {
+	return nil
+}
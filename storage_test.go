@@ -0,0 +1,184 @@
+// storage_test - Test Suite for the db_demo Storage Backends.
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+//
+// Test the Hash Index -- Kept in step with Put and Delete
+//
+func TestHashIndex(t *testing.T) {
+	s := newMemStorage(benchPages(5))
+	testCheck(s.Put(Page{Name: "Henry"}))
+	testCheck(s.Delete("Page 1"))
+	testCheck(s.Put(Page{Name: "Page 3", Body: []byte("New Data")}))
+
+	for i, p := range s.pages {
+		if p.Index != i || s.byName[p.Name] != i {
+			t.Errorf("%s: Index = %d, Hash Index = %d, position = %d", p.Name, p.Index, s.byName[p.Name], i)
+		}
+	}
+	if len(s.byName) != len(s.pages) {
+		t.Errorf("Hash Index has %d names for %d pages", len(s.byName), len(s.pages))
+	}
+	if p, ok := s.Get("Page 3"); !ok || string(p.Body) != "New Data" || p.Index != 2 {
+		t.Error("Page 3 = ", p, ok)
+	}
+	if _, ok := s.Get("Page 1"); ok {
+		t.Error("Page 1 still indexed after Delete")
+	}
+}
+
+//
+// Test the Handlers against every Storage Backend -- Results must be identical
+//
+func TestStorageBackends(t *testing.T) {
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+
+	results := map[string][]Page{}
+	views := map[string]string{}
+	for _, kind := range []string{"file", "disk", "dir", "memory"} {
+		removeDatabase()
+		*storageKind = kind
+		loadDatabase()
+
+		testRequest(editHandler, "GET", "/edit/Henry", "")
+		testRequest(saveHandler, "POST", "/save/Henry", "body=Henry Data")
+		testRequest(deleteHandler, "GET", "/delete/Ann", "")
+		views[kind] = testRequest(viewHandler, "GET", "/view/", "").Body.String()
+
+		if _, ok := findExactName(db, "Ann"); ok {
+			t.Errorf("%s: Ann still present after delete", kind)
+		}
+		if p, _ := db.Get("Ann"); p.Deleted.IsZero() {
+			t.Errorf("%s: Ann not in the trash", kind)
+		}
+		if err := db.Delete("Ann"); err != errNotFound {
+			t.Errorf("%s: Delete of a trashed name returned %v", kind, err)
+		}
+		testCheck(db.Apply([]Op{{Op: "purge", Name: "Ann"}}))
+		results[kind] = pageContents(db.List())
+		if err := db.Delete("Ann"); err != errNotFound {
+			t.Errorf("%s: Delete of a missing name returned %v", kind, err)
+		}
+		if err := db.Put(Page{}); err != errBlankName {
+			t.Errorf("%s: Put of a blank name returned %v", kind, err)
+		}
+	}
+	removeDatabase()
+
+	for _, kind := range []string{"file", "disk", "dir"} {
+		if !reflect.DeepEqual(results[kind], results["memory"]) {
+			t.Errorf("\n%-6s = %v\nmemory = %v", kind, results[kind], results["memory"])
+		}
+		if views[kind] != views["memory"] {
+			t.Errorf("View didn't match:\n\t%s:\t%q\n\tmemory:\t%q", kind, views[kind], views["memory"])
+		}
+	}
+	henry := results["memory"][len(results["memory"])-1]
+	if henry.Name != "Henry" || string(henry.Body) != "Henry Data" || henry.Index != 4 {
+		t.Error("Henry not saved: ", henry)
+	}
+}
+
+//
+// Benchmark Database -- n Pages named "Page <i>"
+//
+func benchPages(n int) []Page {
+	pages := make([]Page, n)
+	for i := range pages {
+		pages[i] = Page{Index: i, Name: fmt.Sprint("Page ", i), Body: []byte("Data")}
+	}
+	return pages
+}
+
+//
+// Linear Scan -- How exact lookups were done before the Hash Index
+//
+func linearFind(pages []Page, name string) (Page, bool) {
+	for _, p := range pages {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Page{}, false
+}
+
+//
+// Benchmark exact lookups: Hash Index against the Linear Scan
+//
+func BenchmarkGetHashIndex(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		s := newMemStorage(benchPages(n))
+		name := fmt.Sprint("Page ", n-1) // Worst case for a scan
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, ok := findExactName(s, name); !ok {
+					b.Fatal("not found: ", name)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetLinearScan(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		pages := benchPages(n)
+		name := fmt.Sprint("Page ", n-1) // Worst case for a scan
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, ok := linearFind(pages, name); !ok {
+					b.Fatal("not found: ", name)
+				}
+			}
+		})
+	}
+}
+
+//
+// Test concurrent Handlers -- Run with "go test -race"
+//
+// Afterwards Data.db plus Data.log must reload to exactly the in-memory state.
+//
+func TestConcurrentHandlers(t *testing.T) {
+	removeDatabase()
+	loadDatabase()
+	defer removeDatabase()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				name := fmt.Sprint("Page ", g, "-", i%5)
+				testRequest(editHandler, "GET", "/edit/"+name, "")
+				testRequest(saveHandler, "POST", "/save/"+name, fmt.Sprint("body=Data ", i))
+				testRequest(viewHandler, "GET", "/view/", "")
+				testRequest(viewHandler, "GET", "/view/Page", "")
+				if i%3 == 0 {
+					testRequest(deleteHandler, "GET", "/delete/"+name, "")
+				}
+				if g == 0 && i == 10 {
+					testCheck(db.(*fileStorage).checkpoint())
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	want := db.List()
+	for i, p := range want {
+		if p.Index != i {
+			t.Errorf("%s: Index = %d, position = %d", p.Name, p.Index, i)
+		}
+	}
+	loadDatabase() // Restart -- Snapshot plus Log
+	if !reflect.DeepEqual(db.List(), want) {
+		t.Error("\nAfter Replay   = ", db.List(), "\nExpected       = ", want)
+	}
+}
@@ -0,0 +1,102 @@
+// trash - Deleted Pages are kept in a Trash.
+// /delete/ marks a Page with the time it was deleted instead of removing
+// it. From then on the lookups and views treat it as gone, /trash/ lists
+// it and /restore/name brings it back as it was. The Sweeper purges it
+// for good once it has been in the trash for -trash-purge.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var trashPurge = flag.Duration("trash-purge", 30*24*time.Hour, "Deleted Pages are purged from the trash after this long (0 keeps them)")
+
+//
+// In the Trash -- Page was deleted and has not expired since
+//
+func inTrash(p Page, t time.Time) bool {
+	return !p.Deleted.IsZero() && !expired(p, t)
+}
+
+//
+// Move a Page to the Trash -- Kept with its Body and revisions, stamped t
+//
+// errNotFound if there is no live Page by that Name. Only Deleted changes,
+// in one Operation, so the Body does not go along with it.
+//
+func trashPage(s Storage, name string, t time.Time) error {
+	return opError(s.Apply([]Op{{Op: "trash", Name: name, Deleted: t}}))
+}
+
+//
+// Restore a Page from the Trash -- errNotFound if it is not there
+//
+func restorePage(s Storage, name string) error {
+	return opError(s.Apply([]Op{{Op: "restore", Name: name}}))
+}
+
+//
+// Purge -- Delete every Page in the Trash longer than age at t, returns how many went
+//
+func purgeTrash(s Storage, t time.Time, age time.Duration) (int, error) {
+	purged := 0
+	for _, p := range listPages(s) {
+		if p.Deleted.IsZero() || t.Before(p.Deleted.Add(age)) {
+			continue
+		}
+		ok, err := deleteVersion(s, p)
+		if err != nil {
+			return purged, err
+		}
+		if ok {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+//
+// Trash Handler --
+//
+// localhost:8080/trash/  -- Lists the deleted Pages
+//
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	var body string
+	t := now()
+	for _, p := range listPages(db) {
+		if !inTrash(p, t) {
+			continue
+		}
+		line := fmt.Sprint(p.Name, " : deleted ", p.Deleted.Format(time.RFC3339))
+		if *trashPurge > 0 {
+			line += fmt.Sprint(", purged after ", p.Deleted.Add(*trashPurge).Format(time.RFC3339))
+		}
+		body += fmt.Sprintln(line)
+	}
+	if len(body) <= 0 {
+		fmt.Fprintf(w, "<h1>Trash: %s</h1>", "Empty")
+		return
+	}
+	fmt.Fprintf(w, "<h1>Trash contains the following Names:</h1>"+
+		"<textarea nameM=\"body\" rows=\"20\" cols=\"80\">%s</textarea><br>"+
+		"Bring one back with /restore/name", body)
+}
+
+//
+// Restore Handler --
+//
+// localhost:8080/restore/name  -- Brings "name" back from the Trash
+//
+func trashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len("/restore/"):]
+	err := restorePage(db, name)
+	if err == errNotFound {
+		fmt.Fprintf(w, "<h1>Restore: '%s' %s</h1>", name, "not in the trash!")
+		return
+	}
+	check("Restore Failed", err)
+	http.Redirect(w, r, "/view/"+name, http.StatusFound)
+}
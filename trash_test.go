@@ -0,0 +1,158 @@
+// trash_test - Test Suite for the db_demo Trash.
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Test delete and restore -- A deleted Page is hidden, listed in /trash/ and comes back as it was
+//
+func TestTrashRestore(t *testing.T) {
+	testDatabase([]byte(cajmj_db))
+	before, _ := db.Get("Ann")
+	testRequest(deleteHandler, "GET", "/delete/Ann", "")
+
+	if _, ok := findName(db, "Ann"); ok {
+		t.Error("findName found a deleted Page")
+	}
+	cases := []struct {
+		h    http.HandlerFunc
+		url  string
+		want string
+	}{
+		{viewHandler, "/view/Ann", "Name not found!"},
+		{idHandler, "/id/" + before.ID, "ID not found!"},
+		{viewHandler, "/view/", "Record  0 :  Charles \nRecord  1 :  Jack \nRecord  2 :  Mike \nRecord  3 :  Jacky \n"},
+		{trashHandler, "/trash/", "Ann : deleted "},
+		{deleteHandler, "/delete/Ann", "<h1>Delete: 'Ann' not found!</h1>"},
+		{trashRestoreHandler, "/restore/Mike", "<h1>Restore: 'Mike' not in the trash!</h1>"},
+		{trashRestoreHandler, "/restore/Henry", "<h1>Restore: 'Henry' not in the trash!</h1>"},
+	}
+	for _, c := range cases {
+		if got := testRequest(c.h, "GET", c.url, "").Body.String(); !strings.Contains(got, c.want) {
+			t.Errorf("%s = %q\n\tExpected it to contain %q", c.url, got, c.want)
+		}
+	}
+
+	if w := testRequest(trashRestoreHandler, "GET", "/restore/Ann", ""); w.Code != http.StatusFound {
+		t.Errorf("Restore = %d %q", w.Code, w.Body.String())
+	}
+	p, ok := findExactName(db, "Ann")
+	if !ok || p.ID != before.ID || p.Index != before.Index || string(p.Body) != "Ann Data" || p.Rev != before.Rev {
+		t.Error("\nBefore   = ", before, "\nRestored = ", p)
+	}
+	if got := testRequest(trashHandler, "GET", "/trash/", "").Body.String(); got != "<h1>Trash: Empty</h1>" {
+		t.Errorf("Trash after restore = %q", got)
+	}
+}
+
+//
+// Test saving a deleted Name -- Brought back with its history
+//
+func TestSaveOverTrash(t *testing.T) {
+	testDatabase([]byte(cajmj_db))
+	testRequest(deleteHandler, "GET", "/delete/Ann", "")
+	testRequest(editHandler, "GET", "/edit/Ann", "") // Creates it again -- Empty Body
+	p, ok := findExactName(db, "Ann")
+	if !ok || len(p.Body) != 0 || len(p.History) != 1 || string(p.History[0].Body) != "Ann Data" {
+		t.Error("Saved over the trash: ", p)
+	}
+
+	testRequest(deleteHandler, "GET", "/delete/Ann", "")
+	testRequest(batchHandler, "POST", "/batch/", "[{\"Op\":\"put\",\"Name\":\"Ann\",\"Body\":\"Batch Data\"}]")
+	if p, ok := findExactName(db, "Ann"); !ok || string(p.Body) != "Batch Data" || len(p.History) != 2 {
+		t.Error("Batch put over the trash: ", p)
+	}
+}
+
+//
+// Test delete ALL -- Every Page goes to the trash
+//
+func TestTrashAll(t *testing.T) {
+	defer func(dir string) { *snapshotDir = dir }(*snapshotDir)
+	*snapshotDir = t.TempDir()
+	testDatabase([]byte(cajmj_db))
+	confirmDeleteAll(t)
+	if got := testRequest(viewHandler, "GET", "/view/Jack", "").Body.String(); got != "<h1>View: Empty Database</h1>" {
+		t.Errorf("View after delete ALL = %q", got)
+	}
+	trash := testRequest(trashHandler, "GET", "/trash/", "").Body.String()
+	for _, name := range []string{"Charles", "Ann", "Jack", "Mike", "Jacky"} {
+		if !strings.Contains(trash, name+" : deleted ") {
+			t.Errorf("%s not in the trash: %q", name, trash)
+		}
+	}
+}
+
+//
+// Test the trash and restore Operations -- Only Deleted and the Version change, on every backend
+//
+func TestTrashOps(t *testing.T) {
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+	defer removeDatabase()
+	for _, kind := range []string{"file", "disk", "dir", "memory"} {
+		removeDatabase()
+		*storageKind = kind
+		loadDatabase()
+
+		before, _ := db.Get("Ann")
+		stale := []Op{{Op: "trash", Name: "Ann", Version: before.Version + 1, Deleted: now()}}
+		if err := db.Apply(stale); opError(err) != errConflict {
+			t.Errorf("%s: stale trash = %v; Expected %v", kind, err, errConflict)
+		}
+		if err := restorePage(db, "Ann"); err != errNotFound {
+			t.Errorf("%s: restore of a live Page = %v; Expected %v", kind, err, errNotFound)
+		}
+		testCheck(trashPage(db, "Ann", now()))
+		if kind != "memory" {
+			loadDatabase() // The trash survives a restart
+		}
+		testCheck(restorePage(db, "Ann"))
+		if kind != "memory" {
+			loadDatabase() // So does the restore
+		}
+		p, ok := db.Get("Ann")
+		if !ok || !p.Deleted.IsZero() || p.Version != before.Version+2 || string(p.Body) != "Ann Data" || p.Rev != before.Rev {
+			t.Errorf("%s:\nBefore   = %v\nRestored = %v", kind, before, p)
+		}
+	}
+}
+
+//
+// Test the Purge -- Pages in the trash longer than the age are deleted, on every backend
+//
+func TestPurgeTrash(t *testing.T) {
+	defer func(kind string) { *storageKind = kind }(*storageKind)
+	defer removeDatabase()
+	for _, kind := range []string{"file", "disk", "dir", "memory"} {
+		removeDatabase()
+		*storageKind = kind
+		loadDatabase()
+
+		t0 := now()
+		testCheck(trashPage(db, "Ann", t0.Add(-2*time.Hour)))
+		testCheck(trashPage(db, "Jack", t0))
+		if err := trashPage(db, "Jack", t0); err != errNotFound {
+			t.Errorf("%s: Jack deleted twice: %v", kind, err)
+		}
+		if kind != "memory" {
+			loadDatabase() // The trash survives a restart
+		}
+		if n, err := purgeTrash(db, t0, time.Hour); n != 1 || err != nil {
+			t.Errorf("%s: purgeTrash = %d, %v; Expected 1", kind, n, err)
+		}
+		if _, ok := db.Get("Ann"); ok {
+			t.Errorf("%s: Ann not purged", kind)
+		}
+		if p, ok := db.Get("Jack"); !ok || !p.Deleted.Equal(t0) || string(p.Body) != "Jack Data" {
+			t.Errorf("%s: Jack = %v, Expected in the trash", kind, p)
+		}
+		if n, _ := sweepExpired(db, t0); n != 0 {
+			t.Errorf("%s: Sweep removed %d Pages from the trash", kind, n)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// trigram - Substring Search Index over Page Names.
+// Every Name is split into its 3-byte substrings (trigrams). A Name can
+// only contain a search string if it has all of the search string's
+// trigrams, so only those candidates are checked with strings.Contains.
+package main
+
+type trigramIndex map[string]map[string]bool // Trigram ==> set of Names
+
+//
+// Trigrams of s -- Each distinct 3-byte substring once
+//
+func trigrams(s string) []string {
+	var grams []string
+	seen := map[string]bool{}
+	for i := 0; i+3 <= len(s); i++ {
+		g := s[i : i+3]
+		if !seen[g] {
+			seen[g] = true
+			grams = append(grams, g)
+		}
+	}
+	return grams
+}
+
+//
+// Add a Name to the Index
+//
+func (t trigramIndex) add(name string) {
+	for _, g := range trigrams(name) {
+		if t[g] == nil {
+			t[g] = map[string]bool{}
+		}
+		t[g][name] = true
+	}
+}
+
+//
+// Remove a Name from the Index
+//
+func (t trigramIndex) remove(name string) {
+	for _, g := range trigrams(name) {
+		delete(t[g], name)
+		if len(t[g]) == 0 {
+			delete(t, g)
+		}
+	}
+}
+
+//
+// Candidates -- Names that have every trigram of substr
+//
+// Returns false when substr is shorter than a trigram; every Name is then
+// a candidate and the caller has to scan.
+//
+func (t trigramIndex) candidates(substr string) ([]string, bool) {
+	grams := trigrams(substr)
+	if len(grams) == 0 {
+		return nil, false
+	}
+	smallest := grams[0] // Walk the shortest posting list, probe the others
+	for _, g := range grams[1:] {
+		if len(t[g]) < len(t[smallest]) {
+			smallest = g
+		}
+	}
+	var names []string
+	for name := range t[smallest] {
+		all := true
+		for _, g := range grams {
+			if !t[g][name] {
+				all = false
+				break
+			}
+		}
+		if all {
+			names = append(names, name)
+		}
+	}
+	return names, true
+}
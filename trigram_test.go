@@ -0,0 +1,129 @@
+// trigram_test - Test Suite for the db_demo Substring Search Index.
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// Linear Contains -- How findName matched before the Trigram Index
+//
+func linearSearch(pages []Page, substr string) []string {
+	var found []string
+	for _, p := range pages {
+		if strings.Contains(p.Name, substr) {
+			found = append(found, p.Name)
+		}
+	}
+	return found
+}
+
+//
+// Test Search -- Same Names as a strings.Contains scan, through every mutation
+//
+func TestSearch(t *testing.T) {
+	s := newMemStorage(append(testData(), benchPages(200)...))
+	queries := []string{"", "a", "Ja", "Jac", "Jack", "Jacky", "ack", "harl", "Page 1", "Page 19", "ge 7", "zzz", "Page 1999"}
+
+	compare := func(when string) {
+		for _, q := range queries {
+			want := linearSearch(s.List(), q)
+			if got := s.Search(q); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: Search(%q)\n\tExpected:\t%q\n\tGot:\t%q", when, q, want, got)
+			}
+		}
+	}
+	compare("load")
+	testCheck(s.Put(Page{Name: "Jackson"}))
+	testCheck(s.Put(Page{Name: "Page 1999"}))
+	compare("put")
+	testCheck(s.Delete("Jack"))
+	testCheck(s.Delete("Page 17"))
+	compare("delete")
+	s.reset(testData())
+	compare("reset")
+}
+
+//
+// Test findName -- A unique contains-match wins, otherwise an exact match
+//
+func TestFindNameRules(t *testing.T) {
+	cases := []struct {
+		name string
+		want string // Name of the returned Page
+		ok   bool
+	}{
+		{"harl", "Charles", true}, // Unique contains-match (trigram path)
+		{"Mi", "Mike", true},      // Unique contains-match (short scan path)
+		{"Jacky", "Jacky", true},  // Unique contains-match
+		{"Jack", "Jack", true},    // Two contains-matches, exact match wins
+		{"Jac", "Jacky", false},   // Two contains-matches, no exact match
+		{"Henry", "", false},      // No match
+	}
+	s := newMemStorage(testData())
+	for _, c := range cases {
+		p, ok := findName(s, c.name)
+		if p.Name != c.want || ok != c.ok {
+			t.Errorf("findName(%q) = %q, %v; Expected %q, %v", c.name, p.Name, ok, c.want, c.ok)
+		}
+	}
+}
+
+type getCounter struct { // Disk Storage that counts the Pages read in full
+	*diskStorage
+	gets int
+}
+
+func (s *getCounter) Get(name string) (Page, bool) {
+	s.gets++
+	return s.diskStorage.Get(name)
+}
+
+//
+// Test findName reads -- Matches come from metadata; one Page is read from disk
+//
+func TestFindNameReads(t *testing.T) {
+	removeDatabase()
+	defer removeDatabase()
+	d, err := openDiskStorage(pagesFile, 16)
+	testCheck(err)
+	defer d.Close()
+	cases := []struct {
+		name string
+		body string // Body of the returned Page
+		ok   bool
+	}{
+		{"harl", "Charles Data", true}, // Unique contains-match
+		{"Jack", "Jack Data", true},    // Two contains-matches, exact match wins
+		{"Jac", "", false},             // Two contains-matches, no exact match
+	}
+	for _, c := range cases {
+		s := &getCounter{diskStorage: d}
+		p, ok := findName(s, c.name)
+		if string(p.Body) != c.body || ok != c.ok || s.gets != 1 {
+			t.Errorf("findName(%q) = %q, %v after %d reads; Expected %q, %v after 1", c.name, p.Body, ok, s.gets, c.body, c.ok)
+		}
+	}
+}
+
+//
+// Benchmark substring lookups: Trigram Index against the Linear Contains
+//
+func BenchmarkSearchTrigram(b *testing.B) {
+	s := newMemStorage(benchPages(100000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Search(fmt.Sprint("Page 9999", i%10))
+	}
+}
+
+func BenchmarkSearchLinear(b *testing.B) {
+	pages := benchPages(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linearSearch(pages, fmt.Sprint("Page 9999", i%10))
+	}
+}
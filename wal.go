@@ -0,0 +1,378 @@
+// wal - Write-Ahead Log for the db_demo File Storage.
+// Every change to the in-memory database is appended to Data.log as one
+// JSON record per line. At startup the log is replayed over the last
+// snapshot (Data.db) and a background checkpoint folds it back into Data.db.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type logRecord struct { // Write-Ahead Log Record
+	Op    string // Operation: "base", "put", "delete", "batch" or "page" (disk.go)
+	Page  Page   // Page the Operation applies to
+	Sum   uint32 `json:",omitempty"` // "base" only: CRC32 of the Snapshot the Log applies to
+	Batch []Op   `json:",omitempty"` // "batch" only: Every Operation, applied as one
+	Kept  int    `json:",omitempty"` // "put" only: Page.History leaves out this many stored revisions (see history.go)
+
+	Sealed []byte `json:",omitempty"` // The whole record, encrypted (see crypt.go) -- Only on disk
+}
+
+//
+// Commit a change -- Append it to the Log, then apply it to the in-memory database
+//
+// logMu makes writers take turns, so the Log holds the changes in exactly
+// the order they were applied. Readers only ever see changes already in the Log.
+// The flush to disk comes after logMu is released (see fsync.go), so
+// writers arriving meanwhile share it.
+//
+func (s *fileStorage) commit(rec logRecord) error {
+	seq, err := s.logAndApply(rec)
+	if err != nil {
+		return err
+	}
+	return s.syncs.wait(seq) // Durable before the Client sees the Result
+}
+
+//
+// Log and apply a change (under logMu) -- Returns the write to wait for
+//
+func (s *fileStorage) logAndApply(rec logRecord) (int64, error) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	if err := s.validate(&rec); err != nil { // Reject before anything is written
+		return 0, err
+	}
+	logged, err := logForm(rec, s.storedHistory) // Only the revisions rec adds
+	if err != nil {
+		return 0, err
+	}
+	if err := s.appendLog(logged); err != nil {
+		return 0, err
+	}
+	seq := s.syncs.wrote()
+	return seq, s.applyRecord(rec) // Change the in-memory Database
+}
+
+//
+// Validate a Log Record against the in-memory database
+//
+// A put gets its stable ID here, so the Log replays to the same IDs.
+//
+func (s *memStorage) validate(rec *logRecord) error {
+	switch rec.Op {
+	case "put":
+		if len(rec.Page.Name) <= 0 {
+			return errBlankName
+		}
+		s.mu.RLock()
+		p, err := s.withID(rec.Page)
+		if err == nil {
+			err = s.checkVersion(p) // Same check again when applied -- Nothing changes in between
+		}
+		s.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		rec.Page = p
+	case "delete":
+		if p, ok := s.Get(rec.Page.Name); !ok || !live(p, now()) {
+			return errNotFound // Expired or trashed -- As for a delete in a Batch
+		}
+	case "batch":
+		s.mu.RLock()
+		ops, err := s.checkBatch(rec.Batch, now())
+		s.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		rec.Batch = ops
+	default:
+		return fmt.Errorf("unknown log operation %q", rec.Op)
+	}
+	return nil
+}
+
+//
+// Apply a Log Record to the in-memory database
+//
+//	put    -- Replace the Page with Page.Name (or append it at the end)
+//	delete -- Remove the Page with Page.Name and renumber the rest
+//	batch  -- Every Operation of the Batch, or none
+//
+func (s *fileStorage) applyRecord(rec logRecord) error {
+	switch rec.Op {
+	case "batch":
+		return s.memStorage.applyLogged(rec.Batch)
+	case "put":
+		return s.memStorage.Put(rec.Page)
+	case "delete":
+		return opError(s.memStorage.applyLogged([]Op{{Op: "purge", Name: rec.Page.Name}}))
+	}
+	return fmt.Errorf("unknown log operation %q", rec.Op)
+}
+
+//
+// Append a Record to the Log
+//
+// The first append after a Checkpoint creates Data.log; its directory is
+// flushed before the record counts as written, so a crash after the fsync
+// of the Log (syncLog) cannot lose the whole file.
+//
+func (s *fileStorage) appendLog(rec logRecord) error {
+	var buf bytes.Buffer
+	if s.logRecords == 0 { // New Log -- Record which Snapshot it applies to
+		base, err := json.Marshal(logRecord{Op: "base", Sum: s.snapshotSum})
+		if err != nil {
+			return err
+		}
+		buf.Write(append(base, '\n'))
+	}
+	data, err := marshalRecord(rec)
+	if err != nil {
+		return err
+	}
+	buf.Write(append(data, '\n'))
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if s.logRecords == 0 {
+		flags |= os.O_TRUNC // Discard any Log already folded into the Snapshot
+	}
+	f, err := os.OpenFile(s.log, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if s.logRecords == 0 && s.syncs.policy != "none" { // New file -- Its name must be on disk too
+		if err := syncDir(filepath.Dir(s.log)); err != nil {
+			return err
+		}
+	}
+	s.logRecords++
+	return nil
+}
+
+//
+// Flush the Log to disk -- No Log: Checkpointed, already in the Snapshot
+//
+func (s *fileStorage) syncLog() error {
+	f, err := os.OpenFile(s.log, os.O_WRONLY, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+//
+// Marshal a Log Record -- Every Page it carries gets its checksum and is compressed,
+// then the record is sealed when a key is set
+//
+func marshalRecord(rec logRecord) ([]byte, error) {
+	if rec.Op == "put" || rec.Op == "page" {
+		rec.Page.Sum = pageSum(rec.Page)
+		rec.Page = packPage(rec.Page)
+	}
+	rec.Batch = append([]Op(nil), rec.Batch...) // Never change the caller's Operations
+	for i := range rec.Batch {
+		if rec.Batch[i].Op == "put" {
+			rec.Batch[i].Page.Sum = pageSum(rec.Batch[i].Page)
+			rec.Batch[i].Page = packPage(rec.Batch[i].Page)
+		}
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return sealLine(data)
+}
+
+//
+// Replay the Log over the Snapshot
+//
+// A Log whose "base" record does not match the Snapshot was already folded
+// into it by a Checkpoint and is ignored. A torn last record (crash
+// mid-append, no trailing newline) is cut off; any other bad record,
+// including a put whose checksum does not match, is an error.
+//
+func (s *fileStorage) replayLog() error {
+	data, err := ioutil.ReadFile(s.log)
+	if os.IsNotExist(err) {
+		return nil // No Log -- Snapshot is current
+	}
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	good := 0 // Length of the Log up to the last complete record
+	for n, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		if n == len(lines)-1 { // Torn Tail -- No trailing newline
+			fmt.Println("Log: dropping incomplete last record")
+			return os.Truncate(s.log, int64(good))
+		}
+		rec, err := decodeRecord(line)
+		if err != nil {
+			return fmt.Errorf("log record %d: %v", n+1, err)
+		}
+		good += len(line) + 1
+		if n == 0 {
+			if rec.Op != "base" {
+				return fmt.Errorf("log record 1: missing base record")
+			}
+			if rec.Sum != s.snapshotSum {
+				fmt.Println("Log: already folded into snapshot - ignored")
+				return nil
+			}
+			continue
+		}
+		if rec.Op == "put" && len(rec.Page.ID) <= 0 {
+			s.unsaved = true // Written before stable IDs -- ID assigned now
+		}
+		if !checkLogSum(&rec.Page) {
+			return fmt.Errorf("log record %d: checksum mismatch", n+1)
+		}
+		for i := range rec.Batch {
+			if !checkLogSum(&rec.Batch[i].Page) {
+				return fmt.Errorf("log record %d, operation %d: checksum mismatch", n+1, i)
+			}
+		}
+		if err := s.fullForm(&rec); err != nil {
+			return fmt.Errorf("log record %d: %v", n+1, err)
+		}
+		if err := s.applyRecord(rec); err != nil {
+			return fmt.Errorf("log record %d: %v", n+1, err)
+		}
+		s.logRecords++
+	}
+	return nil
+}
+
+//
+// Revisions of the Page stored under name -- What a put is logged against
+//
+func (s *fileStorage) storedHistory(name string) ([]Revision, error) {
+	p, _ := s.memStorage.Get(name)
+	return p.History, nil
+}
+
+//
+// Full form of a logged record -- The revisions it left out, from the Pages as stored
+//
+func (s *fileStorage) fullForm(rec *logRecord) error {
+	var err error
+	if rec.Kept > 0 {
+		history, _ := s.storedHistory(rec.Page.Name)
+		rec.Page.History, err = historyKept(history, rec.Kept, rec.Page.History)
+		rec.Kept = 0
+	}
+	for i := range rec.Batch { // Stored before the Batch -- See deltaPuts
+		op := &rec.Batch[i]
+		if op.Kept > 0 && err == nil {
+			history, _ := s.storedHistory(op.Page.Name)
+			op.Page.History, err = historyKept(history, op.Kept, op.Page.History)
+		}
+		op.Kept = 0
+	}
+	return err
+}
+
+//
+// Expand a logged Page, verify and clear its Sum -- No Sum: Written before checksums
+//
+func checkLogSum(p *Page) bool {
+	if unpackPage(p) != nil {
+		return false
+	}
+	if p.Sum != 0 && p.Sum != pageSum(*p) {
+		return false
+	}
+	p.Sum = 0
+	return true
+}
+
+//
+// Checkpoint -- Fold the Log into a new Snapshot
+//
+func (s *fileStorage) checkpoint() error {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.pruneHistories(now())          // Revisions past -revision-age since their Page was last saved
+	return s.writeSnapshot(s.List()) // Readers keep going
+}
+
+//
+// Restore -- New Snapshot with pages and an empty Log, then swap the in-memory copy
+//
+// Data.db is replaced by one rename, so a crash leaves either the old
+// database or the restored one. The old one is kept as Data.db.prev.
+//
+func (s *fileStorage) Restore(pages []Page) error {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	if err := s.writeSnapshot(pages); err != nil {
+		return err
+	}
+	s.reset(append([]Page(nil), pages...))
+	return nil
+}
+
+//
+// Write pages as the new Snapshot and start a new Log (logMu held)
+//
+func (s *fileStorage) writeSnapshot(pages []Page) error {
+	data, err := encodeSnapshot(pages, s.encoding) // Marshal the Database
+	if err != nil {
+		return err
+	}
+	if err := s.writeData(data); err != nil { // Write new Snapshot
+		return err
+	}
+	s.stampFile() // Not a change made by others
+	s.snapshotSum = crc32.ChecksumIEEE(data)
+	s.logRecords = 0 // Next append starts a new Log against this Snapshot
+	s.unsaved = false
+	err = os.Remove(s.log)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//
+// Checkpointer -- Background Checkpoint every interval while the Log has changes
+//
+func (s *fileStorage) checkpointer(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-tick.C:
+		}
+		s.logMu.Lock()
+		pending := s.logRecords
+		s.logMu.Unlock()
+		if pending > 0 {
+			if err := s.checkpoint(); err != nil {
+				fmt.Println("Checkpoint Failed:", err)
+			}
+		}
+	}
+}
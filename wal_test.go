@@ -0,0 +1,93 @@
+// wal_test - Test Suite for the db_demo Write-Ahead Log.
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// Start every Log test from a freshly created Database
+//
+func freshDatabase() {
+	removeDatabase()
+	loadDatabase()
+}
+
+//
+// Run a Handler against a Request
+//
+func testRequest(h http.HandlerFunc, method, url, body string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest(method, url, strings.NewReader(body))
+	testCheck(err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+//
+// Test Log Replay -- Changes survive a restart with and without a Checkpoint
+//
+func TestReplayLog(t *testing.T) {
+	freshDatabase()
+	testRequest(editHandler, "GET", "/edit/Henry", "")
+	testRequest(deleteHandler, "GET", "/delete/Ann", "")
+	testRequest(saveHandler, "POST", "/save/Jacky", "body=Jacky New Value")
+	want := db.List()
+
+	loadDatabase() // Restart -- Snapshot plus Log
+	if !reflect.DeepEqual(db.List(), want) {
+		t.Error("\nAfter Replay   = ", db.List(), "\nExpected       = ", want)
+	}
+	fs := db.(*fileStorage)
+	if fs.logRecords != 3 {
+		t.Errorf("Log Records = %d, Expected 3", fs.logRecords)
+	}
+
+	testCheck(fs.checkpoint()) // Fold the Log into Data.db
+	if _, err := os.Stat(fs.log); !os.IsNotExist(err) {
+		t.Error("Log still present after Checkpoint")
+	}
+	loadDatabase() // Restart -- Snapshot only
+	if !reflect.DeepEqual(db.List(), want) {
+		t.Error("\nAfter Checkpoint = ", db.List(), "\nExpected         = ", want)
+	}
+}
+
+//
+// Test Log Replay -- Torn last record is cut off and the Log stays usable
+//
+func TestTornLog(t *testing.T) {
+	freshDatabase()
+	testRequest(deleteHandler, "GET", "/delete/Mike", "")
+	want := db.List()
+
+	f, err := os.OpenFile("Data.log", os.O_WRONLY|os.O_APPEND, 0644)
+	testCheck(err)
+	_, err = f.WriteString("{\"Op\":\"put\",\"Page\":{\"Ind") // Crash mid-append
+	testCheck(err)
+	f.Close()
+
+	loadDatabase()
+	if !reflect.DeepEqual(db.List(), want) {
+		t.Error("\nAfter Replay   = ", db.List(), "\nExpected       = ", want)
+	}
+	data, err := ioutil.ReadFile("Data.log")
+	testCheck(err)
+	if !strings.HasSuffix(string(data), "\n") {
+		t.Errorf("Torn record not removed: %q", data)
+	}
+
+	testRequest(deleteHandler, "GET", "/delete/Charles", "")
+	want = db.List()
+	loadDatabase()
+	if !reflect.DeepEqual(db.List(), want) {
+		t.Error("\nAfter Replay   = ", db.List(), "\nExpected       = ", want)
+	}
+}